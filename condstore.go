@@ -0,0 +1,205 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// RFC 7162 support, which go-imap does not provide.
+
+// SELECT mailbox (CONDSTORE)
+type selectCondstore struct {
+	commands.Select
+}
+
+func (cmd *selectCondstore) Command() *imap.Command {
+	c := cmd.Select.Command()
+	c.Arguments = append(c.Arguments, []interface{}{imap.RawString("CONDSTORE")})
+	return c
+}
+
+// SELECT response which also records HIGHESTMODSEQ
+type selectModseq struct {
+	responses.Select
+	modseq uint64
+}
+
+func (r *selectModseq) Handle(resp imap.Resp) error {
+	if s, ok := resp.(*imap.StatusResp); ok && s.Code == "HIGHESTMODSEQ" && len(s.Arguments) > 0 {
+		if str, ok := s.Arguments[0].(string); ok {
+			r.modseq, _ = strconv.ParseUint(str, 10, 64)
+		}
+		return nil
+	}
+	return r.Select.Handle(resp)
+}
+
+// SelectModseq selects a mailbox with CONDSTORE enabled and returns its
+// HIGHESTMODSEQ, which is zero if the mailbox does not support mod-sequences.
+// With readOnly, the mailbox is opened with EXAMINE.
+func SelectModseq(c *client.Client, name string, readOnly bool) (*imap.MailboxStatus, uint64, error) {
+	mbox := &imap.MailboxStatus{Name: name, Items: make(map[imap.StatusItem]interface{})}
+	res := &selectModseq{Select: responses.Select{Mailbox: mbox}}
+	// unilateral EXISTS responses are recorded in the client's mailbox
+	c.SetState(imap.SelectedState, mbox)
+	if status, e := c.Execute(&selectCondstore{commands.Select{Mailbox: name, ReadOnly: readOnly}}, res); e != nil {
+		c.SetState(imap.AuthenticatedState, nil)
+		return nil, 0, e
+	} else if e := status.Err(); e != nil {
+		c.SetState(imap.AuthenticatedState, nil)
+		return nil, 0, e
+	} else {
+		mbox.ReadOnly = status.Code == imap.CodeReadOnly
+		return mbox, res.modseq, nil
+	}
+}
+
+// UID FETCH 1:* items (CHANGEDSINCE modseq [VANISHED])
+type fetchChangedSince struct {
+	commands.Fetch
+	modseq   uint64
+	vanished bool
+}
+
+func (cmd *fetchChangedSince) Command() *imap.Command {
+	c := cmd.Fetch.Command()
+	modifiers := []interface{}{
+		imap.RawString("CHANGEDSINCE"),
+		imap.RawString(strconv.FormatUint(cmd.modseq, 10)),
+	}
+	if cmd.vanished {
+		modifiers = append(modifiers, imap.RawString("VANISHED"))
+	}
+	c.Arguments = append(c.Arguments, modifiers)
+	return c
+}
+
+// FETCH response which also records VANISHED (EARLIER) uids
+type fetchVanished struct {
+	responses.Fetch
+	vanished *imap.SeqSet
+}
+
+func (r *fetchVanished) Handle(resp imap.Resp) error {
+	if name, fields, ok := imap.ParseNamedResp(resp); ok && name == "VANISHED" && len(fields) > 0 {
+		if str, e := imap.ParseString(fields[len(fields)-1]); e != nil {
+			return e
+		} else if seq, e := imap.ParseSeqSet(str); e != nil {
+			return e
+		} else {
+			r.vanished.AddSet(seq)
+		}
+		return nil
+	}
+	return r.Fetch.Handle(resp)
+}
+
+// FetchChangedSince sends the flags of every message changed since modseq to
+// ch, and with QRESYNC adds the uids of the messages expunged since then to
+// vanished, before closing ch. Without QRESYNC, see FindVanished.
+func FetchChangedSince(c *client.Client, modseq uint64, qresync bool, vanished *imap.SeqSet, ch chan *imap.Message) error {
+	defer close(ch)
+	seq := new(imap.SeqSet)
+	seq.AddRange(1, 0)
+	cmd := &commands.Uid{Cmd: &fetchChangedSince{commands.Fetch{SeqSet: seq, Items: uid_fetch_items}, modseq, qresync}}
+	res := &fetchVanished{responses.Fetch{Messages: ch, SeqSet: seq, Uid: true}, vanished}
+	if status, e := c.Execute(cmd, res); e != nil {
+		return e
+	} else {
+		return status.Err()
+	}
+}
+
+// FindVanished adds the uids which are no longer in the selected mailbox to
+// vanished, as QRESYNC would report them, using UID SEARCH ALL.
+func FindVanished(c *client.Client, uids []uint32, vanished *imap.SeqSet) error {
+	existing, e := c.UidSearch(imap.NewSearchCriteria())
+	if e != nil {
+		return e
+	}
+	present := new(imap.SeqSet)
+	present.AddNum(existing...)
+	for _, uid := range uids {
+		if !present.Contains(uid) {
+			vanished.AddNum(uid)
+		}
+	}
+	return nil
+}
+
+// SELECT response which also records MAILBOXID (RFC 8474)
+type selectObjectID struct {
+	responses.Select
+	objectid string
+}
+
+func (r *selectObjectID) Handle(resp imap.Resp) error {
+	if s, ok := resp.(*imap.StatusResp); ok && s.Code == "MAILBOXID" && len(s.Arguments) > 0 {
+		// a parenthesized list of one objectid
+		arg := s.Arguments[0]
+		if list, ok := arg.([]interface{}); ok && len(list) > 0 {
+			arg = list[0]
+		}
+		r.objectid, _ = imap.ParseString(arg)
+		return nil
+	}
+	return r.Select.Handle(resp)
+}
+
+// SelectObjectID selects a mailbox and returns its MAILBOXID, which is empty
+// if the server does not support OBJECTID.
+func SelectObjectID(c *client.Client, name string, readOnly bool) (*imap.MailboxStatus, string, error) {
+	if ok, _ := c.Support("OBJECTID"); !ok {
+		stat, e := c.Select(name, readOnly)
+		return stat, "", e
+	}
+	mbox := &imap.MailboxStatus{Name: name, Items: make(map[imap.StatusItem]interface{})}
+	res := &selectObjectID{Select: responses.Select{Mailbox: mbox}}
+	c.SetState(imap.SelectedState, mbox)
+	if status, e := c.Execute(&commands.Select{Mailbox: name, ReadOnly: readOnly}, res); e != nil {
+		c.SetState(imap.AuthenticatedState, nil)
+		return nil, "", e
+	} else if e := status.Err(); e != nil {
+		c.SetState(imap.AuthenticatedState, nil)
+		return nil, "", e
+	} else {
+		mbox.ReadOnly = status.Code == imap.CodeReadOnly
+		return mbox, res.objectid, nil
+	}
+}
+
+// IDLE response which also reports VANISHED, the expunges of a QRESYNC
+// mailbox, which go-imap does not turn into updates
+type idleVanished struct {
+	responses.Idle
+	changed chan struct{}
+}
+
+func (r *idleVanished) Handle(resp imap.Resp) error {
+	if name, _, ok := imap.ParseNamedResp(resp); ok && name == "VANISHED" {
+		select {
+		case r.changed <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	return r.Idle.Handle(resp)
+}
+
+// IdleVanished idles like Client.Idle until stop is closed, also signalling
+// on changed when messages vanish.
+func IdleVanished(c *client.Client, stop <-chan struct{}, changed chan struct{}) error {
+	if ok, _ := c.Support("IDLE"); !ok {
+		return c.Idle(stop, nil)
+	}
+	res := &idleVanished{responses.Idle{Stop: stop, RepliesCh: make(chan []byte, 10)}, changed}
+	if status, e := c.Execute(&commands.Idle{}, res); e != nil {
+		return e
+	} else {
+		return status.Err()
+	}
+}
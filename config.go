@@ -9,18 +9,38 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/emersion/go-sasl"
 )
 
 type Config struct {
-	filename string
-	folders  []string
-	r        io.ReadCloser // decrypted
-	salt     []byte
-	addr     string
-	a        sasl.Client
+	filename  string
+	folders   []string
+	r         io.ReadCloser // decrypted
+	salt      []byte
+	addr      string
+	account   string // user name, for progress output
+	a         sasl.Client
+	condstore bool // CONDSTORE, or QRESYNC which implies it
+	qresync   bool
+	compress  bool
+	// connections to open to the server, see InitClient
+	connections int
+	options     map[string]FolderOptions
+	// folder patterns, see Discover
+	include   []string
+	exclude   []string
+	canonical Canonical
+}
+
+// per folder settings, see AccountConfig
+type FolderOptions struct {
+	retain  int      // days until expunged from the server, once archived
+	archive int      // days until moved to the \Archive folder, once read and archived
+	tags    []string // added to new messages
+	notify  bool     // notify-send about new messages
 }
 
 type UserInfo struct {
@@ -34,13 +54,26 @@ type UserInfo struct {
 	RefreshToken string `json:"refreshtoken"`
 }
 
+// Name identifies the account of c in error reports.
+func (c *Config) Name() string {
+	if c.account != "" {
+		return c.account
+	}
+	return c.filename
+}
+
 func (c *Config) PrintAuth(m string, ir []byte) string {
-	return fmt.Sprintf("%s %s %s %s", GenerateMailboxID(c.folders[0], c.addr, c.salt), c.addr, m, base64.URLEncoding.EncodeToString(ir))
+	// folders are not discovered yet, an account may have none
+	mailbox_id := "-"
+	if len(c.folders) > 0 {
+		mailbox_id = GenerateMailboxID(c.folders[0], c.addr, c.salt)
+	}
+	return fmt.Sprintf("%s %s %s %s", mailbox_id, c.addr, m, base64.URLEncoding.EncodeToString(ir))
 }
 
 // LoadConfig loads a configuration file (json encoded) and returns the relevant information.
-func LoadConfig(r io.Reader) (salt, addr string, a sasl.Client, e error) {
-	userinfo := make(map[string]string)
+func LoadConfig(r io.Reader) (userinfo map[string]string, a sasl.Client, e error) {
+	userinfo = make(map[string]string)
 
 	// load config from os.Stdin
 	dec := json.NewDecoder(r)
@@ -50,8 +83,6 @@ func LoadConfig(r io.Reader) (salt, addr string, a sasl.Client, e error) {
 	// directory = userinfo["directory"]
 	// os.MkdirAll(directory, os.ModePerm)
 
-	salt = userinfo["salt"]
-	addr = userinfo["imap_server"]
 	switch userinfo["type"] {
 	case "plain":
 		a = sasl.NewPlainClient("", userinfo["user"], userinfo["password"])
@@ -61,15 +92,158 @@ func LoadConfig(r io.Reader) (salt, addr string, a sasl.Client, e error) {
 	case "outlook":
 		config, token := Outlook_Generate_Token(userinfo["clientid"], userinfo["refreshtoken"])
 		a = XOAuth2(userinfo["user"], config, token)
+	default:
+		e = fmt.Errorf("unknown account type %q, expected plain, gmail or outlook", userinfo["type"])
 	}
 	return
 }
 
+// AccountConfig is an account in the config file given with -config, e.g.
+//
+//	{"accounts": [{"credentials": "mail/example.json.gpg", "folders": [
+//		{"name": "INBOX", "notify": true, "retain": 90},
+//		{"name": "Sent", "tags": ["sent"], "archive": 30}],
+//		"include": ["*"], "exclude": ["Junk", "Trash"], "connections": 4,
+//		"compress": true, "canonical_headers": ["Message-ID", "Date"]}]}
+//
+// retain expires messages from the server that many days after they
+// arrived, once archived, and archive moves them to the \Archive folder
+// after that many days, once read and archived. With include patterns, the
+// other folders of the account are discovered, see Config.Discover. Patterns
+// use the wildcards of IMAP LIST: "*" matches every folder, nested ones
+// included, and "%" only those at the top level, see MatchPattern. The
+// folders are synced over as many connections, one by default. compress
+// gzips new messages, and canonical_headers are the headers messages are
+// identified by, Message-ID by default; the credentials file may also set
+// both, as "compress": "gzip" and a comma separated "canonical_headers".
+type AccountConfig struct {
+	Credentials string         `json:"credentials"`
+	Folders     []FolderConfig `json:"folders"`
+	Include     []string       `json:"include"`
+	Exclude     []string       `json:"exclude"`
+	Connections int            `json:"connections"`
+	Compress    bool           `json:"compress"`
+	Canonical   []string       `json:"canonical_headers"`
+}
+
+type FolderConfig struct {
+	Name    string   `json:"name"`
+	Tags    []string `json:"tags"`
+	Notify  bool     `json:"notify"`
+	Retain  int      `json:"retain"`
+	Archive int      `json:"archive"`
+}
+
+// ReadAccounts reads the accounts of the config file given with -config or,
+// without one, of the lines of r in the old format, see ParseAccountLine. A
+// line which cannot be parsed is reported, and its account left out.
+func ReadAccounts(r io.Reader) ([]AccountConfig, error) {
+	if *config_file != "" {
+		var file struct {
+			Accounts []AccountConfig `json:"accounts"`
+		}
+		f, e := os.Open(*config_file)
+		if e != nil {
+			return nil, e
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		// a misspelled option would silently be left at its default
+		dec.DisallowUnknownFields()
+		if e := dec.Decode(&file); e != nil {
+			return nil, fmt.Errorf("%s: %w", *config_file, e)
+		}
+		return file.Accounts, nil
+	}
+	var accounts []AccountConfig
+	for _, cp := range ParseConfInit(r) {
+		if ac, e := ParseAccountLine(cp); e != nil {
+			// the other accounts still run
+			EmitError(cp[0], "", e)
+		} else {
+			accounts = append(accounts, ac)
+		}
+	}
+	return accounts, nil
+}
+
+// ParseAccountLine converts an account in the old format, the credentials
+// file followed by the folders, to an AccountConfig. Folder options follow
+// the name: "INBOX;retain=90;archive=30". Messages of every folder are
+// notified, and those of the second folder tagged as sent.
+func ParseAccountLine(cp []string) (ac AccountConfig, e error) {
+	ac.Credentials = cp[0]
+	for k, f := range cp[1:] {
+		opts := strings.Split(f, ";")
+		fc := FolderConfig{Name: opts[0], Notify: true}
+		if k == 1 {
+			fc.Tags = []string{"sent"}
+		}
+		for _, opt := range opts[1:] {
+			key, value, _ := strings.Cut(opt, "=")
+			n, e := strconv.Atoi(value)
+			if e != nil || n <= 0 {
+				return ac, fmt.Errorf("invalid folder option: %s", opt)
+			}
+			switch key {
+			case "retain":
+				fc.Retain = n
+			case "archive":
+				fc.Archive = n
+			default:
+				return ac, fmt.Errorf("unknown folder option: %s", opt)
+			}
+		}
+		ac.Folders = append(ac.Folders, fc)
+	}
+	return ac, nil
+}
+
+// HandleConfInit opens an account given in the old format.
 func HandleConfInit(cp []string) (c *Config, e error) {
-	if f, e := os.Open(cp[0]); e != nil {
-		return nil, fmt.Errorf("ignoring: %s\n", cp[0])
+	if ac, e := ParseAccountLine(cp); e != nil {
+		return nil, e
+	} else {
+		return OpenAccount(ac)
+	}
+}
+
+// OpenAccount checks the folder settings of ac and opens its credentials,
+// decrypting them with gpg if needed.
+func OpenAccount(ac AccountConfig) (c *Config, e error) {
+	var folders []string
+	options := make(map[string]FolderOptions)
+	if ac.Connections < 0 {
+		return nil, fmt.Errorf("%s: negative connections", ac.Credentials)
+	}
+	for _, h := range ac.Canonical {
+		if h == "" || strings.ContainsAny(h, ", \t\n:") {
+			return nil, fmt.Errorf("%s: invalid canonical header %q", ac.Credentials, h)
+		}
+	}
+	for _, fc := range ac.Folders {
+		if fc.Name == "" {
+			return nil, fmt.Errorf("%s: folder without a name", ac.Credentials)
+		} else if fc.Retain < 0 || fc.Archive < 0 {
+			return nil, fmt.Errorf("%s: %s: negative retain or archive", ac.Credentials, fc.Name)
+		}
+		for _, tag := range fc.Tags {
+			if tag == "" || strings.ContainsAny(tag, " \t\n") {
+				return nil, fmt.Errorf("%s: %s: invalid tag %q", ac.Credentials, fc.Name, tag)
+			}
+		}
+		folders = append(folders, fc.Name)
+		options[fc.Name] = FolderOptions{retain: fc.Retain, archive: fc.Archive, tags: fc.Tags, notify: fc.Notify}
+	}
+	conf := &Config{filename: ac.Credentials, folders: folders, options: options, include: ac.Include, exclude: ac.Exclude, connections: ac.Connections, compress: ac.Compress}
+	if len(ac.Canonical) > 0 {
+		conf.canonical = Canonical(ac.Canonical)
+	}
+	if f, e := os.Open(ac.Credentials); e != nil {
+		return nil, fmt.Errorf("ignoring: %s\n", ac.Credentials)
 	} else if !strings.HasSuffix(f.Name(), ".gpg") {
-		return &Config{cp[0], cp[1:], f, nil, "", nil}, nil
+		conf.r = f
+		return conf, nil
 	} else {
 		// has gpg suffix
 		cmd := exec.Command("/usr/bin/gpg", "-qd", "-")
@@ -79,27 +253,30 @@ func HandleConfInit(cp []string) (c *Config, e error) {
 
 		go func() {
 			defer f.Close()
+			// a failure only fails the account, when its config is loaded
 			if e := cmd.Run(); e != nil {
-				panic(e)
+				wp.CloseWithError(fmt.Errorf("gpg %s: %w", ac.Credentials, e))
+			} else {
+				wp.Close()
 			}
 		}()
-		return &Config{cp[0], cp[1:], rp, nil, "", nil}, nil
+		conf.r = rp
+		return conf, nil
 	}
 }
 
-func ParseConfInit(r io.Reader) ([][]string, int) {
-	var size int
+func ParseConfInit(r io.Reader) [][]string {
 	cp := make([][]string, 0, 4)
 	stdin := bufio.NewReader(r)
 	for {
-		if l, p, e := stdin.ReadLine(); e != nil {
+		// lines of any length, the last one perhaps without a newline
+		l, e := stdin.ReadString('\n')
+		if l = strings.TrimRight(l, "\r\n"); l != "" {
+			cp = append(cp, strings.Split(l, ","))
+		}
+		if e != nil {
 			break
-		} else if p {
-			panic("isPrefix")
-		} else {
-			size += len(strings.Split(fmt.Sprintf("%s", l), ",")) - 1
-			cp = append(cp, strings.Split(fmt.Sprintf("%s", l), ","))
 		}
 	}
-	return cp, size
+	return cp
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAccountLine(t *testing.T) {
+	for _, tc := range []struct {
+		line []string
+		want AccountConfig
+		err  bool
+	}{
+		{
+			[]string{"mail/a.json"},
+			AccountConfig{Credentials: "mail/a.json"},
+			false,
+		},
+		{
+			[]string{"mail/a.json.gpg", "INBOX;retain=90", "Sent;archive=30;retain=365", "Lists"},
+			AccountConfig{Credentials: "mail/a.json.gpg", Folders: []FolderConfig{
+				{Name: "INBOX", Notify: true, Retain: 90},
+				{Name: "Sent", Tags: []string{"sent"}, Notify: true, Retain: 365, Archive: 30},
+				{Name: "Lists", Notify: true},
+			}},
+			false,
+		},
+		{[]string{"a", "INBOX;retain=0"}, AccountConfig{}, true},
+		{[]string{"a", "INBOX;retain=-1"}, AccountConfig{}, true},
+		{[]string{"a", "INBOX;retain"}, AccountConfig{}, true},
+		{[]string{"a", "INBOX;keep=3"}, AccountConfig{}, true},
+	} {
+		got, e := ParseAccountLine(tc.line)
+		if tc.err {
+			if e == nil {
+				t.Errorf("%q: no error", tc.line)
+			}
+		} else if e != nil {
+			t.Errorf("%q: %s", tc.line, e)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestParseConfInit(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	got := ParseConfInit(strings.NewReader("a.json,INBOX\r\n\nb.json," + long + "\nc.json"))
+	want := [][]string{{"a.json", "INBOX"}, {"b.json", long}, {"c.json"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d lines, want %d", len(got), len(want))
+	}
+}
+
+func TestReadAccountsUnknownField(t *testing.T) {
+	defer func(old string) { *config_file = old }(*config_file)
+	*config_file = filepath.Join(t.TempDir(), "config.json")
+	for _, tc := range []struct {
+		json string
+		ok   bool
+	}{
+		{`{"accounts": [{"credentials": "a", "folders": [{"name": "INBOX", "retain": 90}]}]}`, true},
+		{`{"accounts": [{"credentials": "a", "folders": [{"name": "INBOX", "retian": 90}]}]}`, false},
+		{`{"acounts": []}`, false},
+	} {
+		if e := os.WriteFile(*config_file, []byte(tc.json), 0600); e != nil {
+			t.Fatal(e)
+		}
+		if accounts, e := ReadAccounts(nil); tc.ok && (e != nil || len(accounts) != 1) {
+			t.Errorf("%s: %v, %d accounts", tc.json, e, len(accounts))
+		} else if !tc.ok && e == nil {
+			t.Errorf("%s: no error", tc.json)
+		}
+	}
+}
@@ -4,21 +4,37 @@ import (
 	"github.com/emersion/go-imap"
 )
 
-var canonical_header_list = []string{
+// default, see Canonical
+var canonical_header_list = Canonical{
 	"Message-ID",
 }
 
+// identify messages without any canonical header, with a hash of the body
+var fallback_header_list = []string{
+	"Date",
+	"From",
+	"Subject",
+}
+
 // local
 var taglist = []string{"unread", "replied", "offline", "forwarded", "flagged"}
 
 // remote
 var flaglist = []string{"\\Seen", "\\Answered", "\\Deleted", "$Forwarded", "\\Flagged"}
 
-// section: canonical headers for hashing
-var canonical_header_section = &imap.BodySectionName{
+// section: fallback headers
+var fallback_header_section = &imap.BodySectionName{
 	BodyPartName: imap.BodyPartName{
 		Specifier: imap.HeaderSpecifier,
-		Fields:    canonical_header_list,
+		Fields:    fallback_header_list,
+	},
+	Peek: true,
+}
+
+// section: body, without headers
+var text_section = &imap.BodySectionName{
+	BodyPartName: imap.BodyPartName{
+		Specifier: imap.TextSpecifier,
 	},
 	Peek: true,
 }
@@ -34,11 +50,14 @@ var uid_fetch_items = []imap.FetchItem{
 	imap.FetchFlags,
 }
 
-// fetch items: canonical_header
-var canonical_header_fetch_items = []imap.FetchItem{
-	canonical_header_section.FetchItem(),
+// fetch items: fallback identity
+var fallback_fetch_items = []imap.FetchItem{
+	fallback_header_section.FetchItem(),
+	text_section.FetchItem(),
 	imap.FetchUid,
 	imap.FetchFlags,
+	imap.FetchInternalDate,
+	imap.FetchRFC822Size,
 }
 
 // fetch_items: full message
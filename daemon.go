@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// signals of WatchUpdates, by client; each connection has its own, so that
+// discarding the changes of one mailbox leaves those of the others
+var update_signals sync.Map
+
+// WatchUpdates drains the unilateral updates of c, signalling on the channel
+// of UpdateSignal whenever the selected mailbox changes.
+func WatchUpdates(c *client.Client) {
+	updates := make(chan client.Update, 16)
+	changed := make(chan struct{}, 1)
+	update_signals.Store(c, changed)
+	c.Updates = updates
+	go func() {
+		for {
+			select {
+			case u := <-updates:
+				switch u.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate, *client.MessageUpdate:
+					select {
+					case changed <- struct{}{}:
+					default:
+					}
+				}
+			case <-c.LoggedOut():
+				update_signals.Delete(c)
+				return
+			}
+		}
+	}()
+}
+
+// UpdateSignal returns the channel WatchUpdates signals on for c.
+func UpdateSignal(c *client.Client) chan struct{} {
+	if changed, ok := update_signals.Load(c); ok {
+		return changed.(chan struct{})
+	}
+	// not watched, never signals
+	return make(chan struct{}, 1)
+}
+
+// Daemon keeps the clients of ids open, idling on the folders of each
+// account, as many as it has connections. The folders of an account are
+// synced whenever the server reports a change, or at least every poll
+// interval. It returns on SIGINT or SIGTERM.
+func Daemon(ids []*IndexData) {
+	var sync_mutex sync.Mutex
+	accounts := make(map[chan *client.Client][]*IndexData)
+	for _, id := range ids {
+		accounts[id.cc] = append(accounts[id.cc], id)
+	}
+	quit := make(chan struct{})
+	for _, ids := range accounts {
+		// see IdleAccount
+		for k := cap(ids[0].cc); k < len(ids); k++ {
+			id := ids[k]
+			Emit(Event{Event: "polled", Account: id.account, Mailbox: id.mailboxname}, "i %s: no connection left to IDLE, synced every %s\n", filepath.Base(id.filename)[:5], *poll)
+		}
+	}
+	for _, ids := range accounts {
+		go func(ids []*IndexData) {
+			for {
+				if e := IdleAccount(ids, quit); e != nil {
+					// a dropped connection is replaced, and the account synced
+					if dropped, err := ids[0].Reconnect(); err != nil {
+						EmitError(ids[0].account, "", fmt.Errorf("idle: %w", err))
+						return
+					} else if !dropped && !ClosedError(e) {
+						EmitError(ids[0].account, "", fmt.Errorf("idle: %w", e))
+						return
+					}
+				}
+				sync_mutex.Lock()
+				select {
+				case <-quit:
+					sync_mutex.Unlock()
+					return
+				default:
+				}
+				// errors are reported by Sync
+				Sync(ids)
+				sync_mutex.Unlock()
+			}
+		}(ids)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	// wait for a running sync to save its index files
+	sync_mutex.Lock()
+	close(quit)
+	sync_mutex.Unlock()
+}
+
+// IdleAccount idles on the first folders of ids, one per connection of
+// their account, until one of them returns, and returns the first error.
+// All connections are back in the pool when it returns, for the sync.
+func IdleAccount(ids []*IndexData, quit chan struct{}) error {
+	if len(ids) > cap(ids[0].cc) {
+		ids = ids[:cap(ids[0].cc)]
+	}
+	wake := make(chan struct{})
+	var once sync.Once
+	errs := make(chan error, len(ids))
+	for _, id := range ids {
+		go func(id *IndexData) {
+			e := id.Idle(quit, wake)
+			once.Do(func() {
+				close(wake)
+			})
+			errs <- e
+		}(id)
+	}
+	var err error
+	for range ids {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Idle selects the mailbox of id and idles until the server reports a change
+// or the poll interval passes, or quit or wake is closed.
+func (id *IndexData) Idle(quit chan struct{}, wake chan struct{}) error {
+	c := <-id.cc
+	defer func() {
+		id.cc <- c
+	}()
+	if _, e := c.Select(id.mailboxname, *dry_run); e != nil {
+		return e
+	}
+	// discard changes caused by the previous sync on this connection; the
+	// other mailboxes of the account idle on their own
+	changed := UpdateSignal(c)
+	select {
+	case <-changed:
+	default:
+	}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- IdleVanished(c, stop, changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(*poll):
+	case <-quit:
+	case <-wake:
+	case e := <-done:
+		return e
+	}
+	close(stop)
+	return <-done
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// tags for the RFC 6154 special-use attributes of a folder
+var special_use_tags = map[string]string{
+	imap.SentAttr:    "sent",
+	imap.DraftsAttr:  "draft",
+	imap.JunkAttr:    "spam",
+	imap.TrashAttr:   "deleted",
+	imap.ArchiveAttr: "archive",
+	imap.AllAttr:     "all",
+}
+
+// Discover adds the folders of the account which match an include pattern
+// of conf and no exclude pattern, and tags the new messages of every folder
+// with the roles given by its special-use attributes.
+func (conf *Config) Discover(c *client.Client) error {
+	mailboxes := make(chan *imap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+	for m := range mailboxes {
+		selectable := true
+		var roles []string
+		for _, a := range m.Attributes {
+			if tag, ok := special_use_tags[a]; ok {
+				roles = append(roles, tag)
+			} else if a == imap.NoSelectAttr {
+				selectable = false
+			}
+		}
+		o, ok := conf.options[m.Name]
+		if !ok {
+			if !selectable || !MatchFolder(m.Name, m.Delimiter, conf.include, conf.exclude) {
+				continue
+			}
+			conf.folders = append(conf.folders, m.Name)
+		}
+		for _, role := range roles {
+			if !HasTag(o.tags, role) {
+				o.tags = append(o.tags, role)
+			}
+		}
+		conf.options[m.Name] = o
+	}
+	return <-done
+}
+
+// MatchFolder reports whether name matches one of the include patterns and
+// none of the exclude patterns, see MatchPattern.
+func MatchFolder(name string, delim string, include []string, exclude []string) bool {
+	for _, p := range exclude {
+		if MatchPattern(p, name, delim) {
+			return false
+		}
+	}
+	for _, p := range include {
+		if MatchPattern(p, name, delim) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPattern matches name against pattern with the wildcards of the IMAP
+// LIST command: * matches any characters, % any but the hierarchy delimiter
+// delim. Every other character, [ included, stands for itself.
+func MatchPattern(pattern string, name string, delim string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for k := 0; k <= len(name); k++ {
+			if MatchPattern(pattern[1:], name[k:], delim) {
+				return true
+			} else if k == len(name) {
+				break
+			} else if pattern[0] == '%' && delim != "" && strings.HasPrefix(name[k:], delim) {
+				break
+			}
+		}
+		return false
+	default:
+		return name != "" && name[0] == pattern[0] && MatchPattern(pattern[1:], name[1:], delim)
+	}
+}
+
+func HasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
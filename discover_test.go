@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		delim   string
+		match   bool
+	}{
+		{"*", "INBOX", "/", true},
+		{"*", "[Gmail]/Sent Mail", "/", true},
+		{"*", "", "/", true},
+		{"%", "INBOX", "/", true},
+		{"%", "[Gmail]/Sent Mail", "/", false},
+		{"%", "INBOX.Sub", "/", true},
+		{"%", "INBOX.Sub", ".", false},
+		{"[Gmail]/*", "[Gmail]/All Mail", "/", true},
+		{"[Gmail]/*", "G/All Mail", "/", false},
+		{"[Gmail]/%", "[Gmail]/a/b", "/", false},
+		{"*/Sent", "a/b/Sent", "/", true},
+		{"*/Sent", "a/b/Sent2", "/", false},
+		{"INBOX", "INBOX", "/", true},
+		{"INBOX", "INBOX2", "/", false},
+		{"Jun%", "Junk", "", true},
+	} {
+		if got := MatchPattern(tc.pattern, tc.name, tc.delim); got != tc.match {
+			t.Errorf("MatchPattern(%q, %q, %q) = %v", tc.pattern, tc.name, tc.delim, got)
+		}
+	}
+}
+
+func TestMatchFolder(t *testing.T) {
+	include, exclude := []string{"*"}, []string{"[Gmail]/Spam", "Trash"}
+	for name, match := range map[string]bool{
+		"INBOX":             true,
+		"[Gmail]/Sent Mail": true,
+		"[Gmail]/Spam":      false,
+		"Trash":             false,
+	} {
+		if got := MatchFolder(name, "/", include, exclude); got != match {
+			t.Errorf("MatchFolder(%q) = %v", name, got)
+		}
+	}
+	if MatchFolder("INBOX", "/", nil, nil) {
+		t.Errorf("MatchFolder without include patterns")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Event is one step of a run. With -log-format json, events are written to
+// stderr one per line instead of the text progress lines.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Account string    `json:"account,omitempty"`
+	Mailbox string    `json:"mailbox,omitempty"`
+	Count   int       `json:"count"`
+	Bytes   int       `json:"bytes,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Summary adds up the events of a run, see WriteSummary.
+type Summary struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Accounts  int       `json:"accounts"`
+	Mailboxes int       `json:"mailboxes"`
+	New       int       `json:"new"`
+	Flags     int       `json:"flags"`
+	Deleted   int       `json:"deleted"`
+	Bytes     int       `json:"bytes"`
+	Notmuch   string    `json:"notmuch,omitempty"` // "ok" or the error
+	Errors    []Event   `json:"errors"`
+}
+
+var summary = Summary{Start: time.Now(), Errors: []Event{}}
+var event_mutex sync.Mutex
+
+// Emit adds ev to the summary and reports it on stderr, as json or as the
+// text line given by format and args, if any.
+func Emit(ev Event, format string, args ...interface{}) {
+	event_mutex.Lock()
+	defer event_mutex.Unlock()
+	ev.Time = time.Now()
+	switch ev.Event {
+	case "connected":
+		summary.Accounts++
+	case "selected":
+		summary.Mailboxes++
+	case "new":
+		summary.New += ev.Count
+	case "flags":
+		summary.Flags += ev.Count
+	case "deleted":
+		summary.Deleted += ev.Count
+	case "written":
+		summary.Bytes += ev.Bytes
+	case "notmuch":
+		if summary.Notmuch = "ok"; ev.Error != "" {
+			summary.Notmuch = ev.Error
+		}
+	case "error":
+		summary.Errors = append(summary.Errors, ev)
+	}
+	if *log_format == "json" {
+		// a failed write to stderr is not worth failing the run for
+		json.NewEncoder(os.Stderr).Encode(ev)
+	} else if format != "" {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
+
+// EmitError reports e, which happened in mailbox of account, as an error event.
+func EmitError(account string, mailbox string, e error) {
+	ev := Event{Event: "error", Account: account, Mailbox: mailbox, Error: e.Error()}
+	if mailbox != "" {
+		Emit(ev, "%s: %s\n", mailbox, e)
+	} else if account != "" {
+		Emit(ev, "%s: %s\n", account, e)
+	} else {
+		Emit(ev, "%s\n", e)
+	}
+}
+
+// ReportFailures writes the errors of the run to w, grouped by account, and
+// returns their number.
+func ReportFailures(w io.Writer) int {
+	event_mutex.Lock()
+	defer event_mutex.Unlock()
+	errors := append([]Event(nil), summary.Errors...)
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Account < errors[j].Account
+	})
+	for k, ev := range errors {
+		if k == 0 || ev.Account != errors[k-1].Account {
+			if ev.Account == "" {
+				fmt.Fprintln(w, "failed:")
+			} else {
+				fmt.Fprintf(w, "failed %s:\n", ev.Account)
+			}
+		}
+		if ev.Mailbox != "" {
+			fmt.Fprintf(w, "\t%s: %s\n", ev.Mailbox, ev.Error)
+		} else {
+			fmt.Fprintf(w, "\t%s\n", ev.Error)
+		}
+	}
+	return len(errors)
+}
+
+// WriteSummary replaces the file at path with the summary of the run so far.
+func WriteSummary(path string) error {
+	event_mutex.Lock()
+	summary.End = time.Now()
+	b, e := json.MarshalIndent(summary, "", "\t")
+	event_mutex.Unlock()
+	if e != nil {
+		return e
+	}
+	tmp := path + ".tmp"
+	if e := os.WriteFile(tmp, append(b, '\n'), 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, path)
+}
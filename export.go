@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maildir info letters in ASCII order, and their flag bits
+var maildirlist = []byte{'F', 'P', 'R', 'S', 'T'}
+var maildirbits = []byte{0x10, 0x08, 0x02, 0x01, 0x04}
+
+// ResolveIndex returns the index file of a mailbox given either as the path
+// of an index file or a mailbox id in indexdir, or as an account
+// configuration file followed by the mailbox name.
+func ResolveIndex(args []string) (string, error) {
+	switch len(args) {
+	case 1:
+		if _, e := os.Stat(args[0]); e == nil {
+			return args[0], nil
+		}
+		return filepath.Join(*indexdir, args[0]), nil
+	case 2:
+		if conf, e := HandleConfInit(args); e != nil {
+			return "", e
+		} else if e := conf.Load(); e != nil {
+			return "", e
+		} else {
+			return filepath.Join(*indexdir, GenerateMailboxID(args[1], conf.addr, conf.salt)), nil
+		}
+	default:
+		return "", fmt.Errorf("expected <mailbox id> or <config> <mailbox>")
+	}
+}
+
+// MaildirInfo returns the maildir info suffix for flags, e.g. ":2,FS".
+func MaildirInfo(flags byte) string {
+	info := make([]byte, 0, len(maildirlist))
+	for k, c := range maildirlist {
+		if flags&maildirbits[k] != 0 {
+			info = append(info, c)
+		}
+	}
+	return ":2," + string(info)
+}
+
+// ExportMaildir copies every message of the index file into the maildir
+// dir, named after its digest so that exporting again replaces it.
+func ExportMaildir(index string, dir string) error {
+	id := &IndexData{filename: index}
+	if e := id.ReadIndexFile(); e != nil {
+		return e
+	}
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if e := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm); e != nil {
+			return e
+		}
+	}
+	var count, missing int
+	for _, b := range id.indexbytes {
+		digest := b[4 : digest_length+4]
+		body, e := ReadStoreFile(RecordPath(*targetdir, b[:]))
+		if errors.Is(e, ErrStub) || os.IsNotExist(e) {
+			missing++
+			continue
+		} else if e != nil {
+			return e
+		}
+		name := fmt.Sprintf("%02x", digest) + VariantSuffix(b[variant_offset])
+		if old, e := filepath.Glob(filepath.Join(dir, "cur", name+":2,*")); e != nil {
+			return e
+		} else {
+			for _, path := range old {
+				if e := os.Remove(path); e != nil {
+					return e
+				}
+			}
+		}
+		tmp := filepath.Join(dir, "tmp", name)
+		if e := os.WriteFile(tmp, bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n")), 0600); e != nil {
+			return e
+		} else if e := os.Rename(tmp, filepath.Join(dir, "cur", name+MaildirInfo(b[digest_length+4]))); e != nil {
+			return e
+		}
+		count++
+	}
+	fmt.Fprintf(os.Stderr, "e %s: %d messages, %d not archived\n", filepath.Base(index), count, missing)
+	return nil
+}
+
+// FromLine returns the mbox From_ line of a message.
+func FromLine(m *mail.Message) string {
+	sender := "MAILER-DAEMON"
+	if al, e := m.Header.AddressList("Return-Path"); e == nil && len(al) > 0 && al[0].Address != "" {
+		sender = al[0].Address
+	} else if al, e := m.Header.AddressList("From"); e == nil && len(al) > 0 {
+		sender = al[0].Address
+	}
+	date, e := m.Header.Date()
+	if e != nil {
+		date = time.Unix(0, 0)
+	}
+	return fmt.Sprintf("From %s %s\n", sender, date.UTC().Format(time.ANSIC))
+}
+
+var from_line = regexp.MustCompile(`(?m)^(>*From )`)
+
+// WriteMboxrd writes the message body in mboxrd format: the From_ line,
+// the message with LF line endings and every ">*From " line quoted once
+// more, and a blank line.
+func WriteMboxrd(w io.Writer, body []byte) error {
+	m, e := mail.ReadMessage(bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	body = from_line.ReplaceAll(body, []byte(">$1"))
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		body = append(body, '\n')
+	}
+	if _, e := io.WriteString(w, FromLine(m)); e != nil {
+		return e
+	} else if _, e := w.Write(body); e != nil {
+		return e
+	} else if _, e := w.Write([]byte{'\n'}); e != nil {
+		return e
+	}
+	return nil
+}
+
+// ExportMbox writes the messages of the index file, or, if index is empty,
+// the store paths read from stdin (one per line, e.g. from notmuch search
+// --output=files), to the mbox file out.
+func ExportMbox(index string, out string) error {
+	var paths []string
+	if index != "" {
+		id := &IndexData{filename: index}
+		if e := id.ReadIndexFile(); e != nil {
+			return e
+		}
+		id.UidSort()
+		for _, b := range id.indexbytes {
+			paths = append(paths, RecordPath(*targetdir, b[:]))
+		}
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if path := strings.TrimSpace(scanner.Text()); path != "" {
+				paths = append(paths, path)
+			}
+		}
+		if e := scanner.Err(); e != nil {
+			return e
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		if f, e := os.Create(out); e != nil {
+			return e
+		} else {
+			defer f.Close()
+			w = f
+		}
+	}
+	wb := bufio.NewWriter(w)
+	var count, missing int
+	for _, path := range paths {
+		body, e := ReadStoreFile(path)
+		if errors.Is(e, ErrStub) || os.IsNotExist(e) {
+			missing++
+			continue
+		} else if e != nil {
+			return e
+		} else if e := WriteMboxrd(wb, body); e != nil {
+			return fmt.Errorf("%s: %w", path, e)
+		}
+		count++
+	}
+	fmt.Fprintf(os.Stderr, "e %s: %d messages, %d not archived\n", filepath.Base(out), count, missing)
+	return wb.Flush()
+}
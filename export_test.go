@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMaildirInfo(t *testing.T) {
+	for flags, want := range map[byte]string{
+		0x00: ":2,",
+		0x01: ":2,S",
+		0x02: ":2,R",
+		0x04: ":2,T",
+		0x08: ":2,P",
+		0x10: ":2,F",
+		0x1f: ":2,FPRST",
+		0x11: ":2,FS",
+	} {
+		if got := MaildirInfo(flags); got != want {
+			t.Errorf("MaildirInfo(%#x) = %q, want %q", flags, got, want)
+		}
+	}
+}
+
+func TestWriteMboxrd(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			"crlf",
+			"From: A <a@example.com>\r\nDate: Mon, 02 Jan 2006 15:04:05 +0000\r\n\r\nhi\r\n",
+			"From a@example.com Mon Jan  2 15:04:05 2006\nFrom: A <a@example.com>\nDate: Mon, 02 Jan 2006 15:04:05 +0000\n\nhi\n\n",
+		},
+		{
+			"quoted from",
+			"Return-Path: <b@example.com>\nFrom: a@example.com\n\nFrom here\n>From there\nnot From\n",
+			"From b@example.com Thu Jan  1 00:00:00 1970\nReturn-Path: <b@example.com>\nFrom: a@example.com\n\n>From here\n>>From there\nnot From\n\n",
+		},
+		{
+			"no newline",
+			"Subject: x\n\nend",
+			"From MAILER-DAEMON Thu Jan  1 00:00:00 1970\nSubject: x\n\nend\n\n",
+		},
+	} {
+		var w bytes.Buffer
+		if e := WriteMboxrd(&w, []byte(tc.body)); e != nil {
+			t.Errorf("%s: %s", tc.name, e)
+		} else if w.String() != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, w.String(), tc.want)
+		}
+	}
+	if e := WriteMboxrd(new(bytes.Buffer), []byte("not a header line\n")); e == nil {
+		t.Errorf("invalid message: no error")
+	}
+}
@@ -10,54 +10,131 @@ import (
 	"github.com/emersion/go-imap/client"
 )
 
-func (conf *Config) InitClient() (cc chan *client.Client, e error) {
-	salt, addr, a, e := LoadConfig(conf.r)
+// Load reads the (decrypted) configuration file of conf.
+func (conf *Config) Load() error {
+	userinfo, a, e := LoadConfig(conf.r)
 	if e != nil {
-		return nil, e
+		return e
 	}
 	conf.r.Close()
-	conf.addr = addr
+	conf.addr = userinfo["imap_server"]
+	if conf.account = userinfo["user"]; conf.account == "" {
+		conf.account = conf.addr
+	}
+	// the account config wins over the credentials file
+	if userinfo["compress"] == "gzip" {
+		conf.compress = true
+	}
+	if conf.canonical == nil {
+		conf.canonical = ParseCanonical(userinfo["canonical_headers"])
+	}
+	if conf.connections < 1 {
+		conf.connections = 1
+	}
 	conf.a = a
-	if tmp, e := base64.URLEncoding.DecodeString(salt); e != nil {
-		return nil, e
+	if tmp, e := base64.URLEncoding.DecodeString(userinfo["salt"]); e != nil {
+		return e
 	} else {
 		conf.salt = tmp
 	}
+	return nil
+}
+
+func (conf *Config) InitClient() (cc chan *client.Client, e error) {
+	if e := conf.Load(); e != nil {
+		return nil, e
+	}
+	a := conf.a
 	if !*printauth {
 		// do nothing
 	} else if m, ir, e := a.Start(); e != nil {
-		panic(e)
+		return nil, e
 	} else {
 		fmt.Fprintln(os.Stdout, conf.PrintAuth(m, ir))
 	}
-	client_chan := make(chan *client.Client, 1)
-	if c, e := client.DialTLS(addr, nil); e != nil {
+	// the folders of the account share the connections
+	client_chan := make(chan *client.Client, conf.connections)
+	for k := 0; k < conf.connections; k++ {
+		if c, e := conf.Dial(); e != nil {
+			for ; k > 0; k-- {
+				(<-client_chan).Logout()
+			}
+			return nil, e
+		} else if k == 0 {
+			// the special-use roles are wanted without include patterns too
+			if e := conf.Discover(c); e != nil {
+				c.Logout()
+				return nil, e
+			}
+			client_chan <- c
+		} else {
+			client_chan <- c
+		}
+	}
+	Emit(Event{Event: "connected", Account: conf.account, Count: conf.connections}, "")
+	return client_chan, nil
+}
+
+// Dial opens a new connection to the server of conf and authenticates.
+func (conf *Config) Dial() (*client.Client, error) {
+	if c, e := client.DialTLS(conf.addr, nil); e != nil {
 		return nil, e
-	} else if e := c.Authenticate(a); e != nil {
+	} else if e := c.Authenticate(conf.a); e != nil {
+		c.Logout()
 		return nil, e
 	} else {
 		// for idling
 		// defer c.Logout()
-		client_chan <- c
+		if *daemon {
+			WatchUpdates(c)
+		}
+		if ok, _ := c.Support("QRESYNC"); ok {
+			if _, e := c.Enable([]string{"QRESYNC"}); e == nil {
+				conf.qresync, conf.condstore = true, true
+			}
+		}
+		if ok, _ := c.Support("CONDSTORE"); ok {
+			conf.condstore = true
+		}
+		return c, nil
 	}
-	return client_chan, nil
 }
 
+// InitHandler reads the index of every folder of conf. A folder which
+// cannot be selected or read is reported and left out of the run.
 func InitHandler(cc chan *client.Client, conf *Config, unsorted_index_chan chan *IndexData) error {
-	for k, mailbox := range conf.folders {
+	for _, mailbox := range conf.folders {
 		if c := <-cc; c == nil {
 			return fmt.Errorf("client is nil")
-		} else if _, e := c.Select(mailbox, false); e != nil {
-			return e
+		} else if stat, objectid, e := SelectObjectID(c, mailbox, *dry_run); e != nil {
+			cc <- c
+			EmitError(conf.account, mailbox, e)
 		} else {
 			id := new(IndexData)
 			id.filename = filepath.Join(*indexdir, GenerateMailboxID(mailbox, conf.addr, conf.salt))
 			id.cc = cc
-			id.k = k
+			id.dial = conf.Dial
+			id.condstore = conf.condstore
+			id.qresync = conf.qresync
+			id.compress = conf.compress
+			id.options = conf.options[mailbox]
 			id.addr = conf.addr
+			id.account = conf.account
 			id.mailboxname = mailbox
-			if e := id.ReadIndexFile(); e != nil && !os.IsNotExist(e) {
-				return e
+			id.canonical = conf.canonical
+			id.objectid = objectid
+			e := id.ReadIndexFile()
+			if os.IsNotExist(e) {
+				// no index yet, unless the folder was renamed on the server
+				e = id.FindRenamed(c, stat, conf.folders, conf.salt)
+			}
+			if e != nil {
+				cc <- c
+				EmitError(conf.account, mailbox, e)
+			} else if id.canonical.String() != conf.canonical.String() {
+				// the digests in the index are over other headers
+				cc <- c
+				EmitError(conf.account, mailbox, fmt.Errorf("canonical headers changed from %s to %s, run rehash", id.canonical, conf.canonical))
 			} else {
 				unsorted_index_chan <- id
 				cc <- c
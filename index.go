@@ -8,9 +8,9 @@ import (
 	"hash"
 	"io"
 	"net/mail"
-	"os"
 	"path/filepath"
 	"sort"
+	"sync"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
@@ -19,10 +19,23 @@ import (
 type IndexData struct {
 	mailboxname string
 	filename    string
-	k           int
 	addr        string
-	indexbytes  [][digest_length + 5]byte
-	addbuffer   [][5]byte // first byte is flag, rest bytes are uint32
+	account     string
+	objectid    string // MAILBOXID, empty if unknown
+	uidvalidity uint32
+	modseq      uint64 // HIGHESTMODSEQ, zero if unknown
+	condstore   bool
+	qresync     bool
+	canonical   Canonical
+	compress    bool
+	options     FolderOptions
+	indexbytes  [][index_record_size]byte
+	stale       map[string]byte // store paths before a UIDVALIDITY change
+	dial        func() (*client.Client, error)
+	errs        chan error     // of the fetch goroutines, see ForceUpdate
+	busy        sync.WaitGroup // fetch goroutines holding a client
+	err         error          // why the last sync failed
+	addbuffer   [][5]byte      // first byte is flag, rest bytes are uint32
 	cc          chan *client.Client
 }
 
@@ -30,8 +43,32 @@ func read_uint32(x []byte) uint32 {
 	return uint32(x[0]) + uint32(x[1])*256 + uint32(x[2])*65536 + uint32(x[3])*16777216
 }
 
-func (id *IndexData) GenerateIndexTickets() []*IndexTicket {
-	indextickets := make([]*IndexTicket, len(id.indexbytes))
+// seq_len returns the number of UIDs in s, which must not contain "*".
+func seq_len(s *imap.SeqSet) (n int) {
+	for _, set := range s.Set {
+		n += int(set.Stop-set.Start) + 1
+	}
+	return n
+}
+
+func put_uint32(x []byte, v uint32) {
+	for k := 0; k < 4; k++ {
+		x[k] = byte(v % 256)
+		v = v / 256
+	}
+}
+
+func read_uint64(x []byte) uint64 {
+	return uint64(read_uint32(x[:4])) + uint64(read_uint32(x[4:8]))<<32
+}
+
+func put_uint64(x []byte, v uint64) {
+	put_uint32(x[:4], uint32(v))
+	put_uint32(x[4:8], uint32(v>>32))
+}
+
+func (id *IndexData) GenerateIndexTickets() IndexTickets {
+	indextickets := make(IndexTickets, len(id.indexbytes))
 	for k, b := range id.indexbytes {
 		indextickets[k] = &IndexTicket{
 			uid:      read_uint32(b[:4]),
@@ -45,62 +82,116 @@ func (id *IndexData) GenerateIndexTickets() []*IndexTicket {
 	return indextickets
 }
 
-func (id *IndexData) ForceUpdate(path_buffer *bytes.Buffer) {
+// ForceUpdate syncs the mailbox of id. On error, the index of id is left
+// in an unknown state and must not be saved.
+func (id *IndexData) ForceUpdate(path_buffer *bytes.Buffer) (err error) {
 	hasher := sha256.New()
-	fmt.Fprintf(os.Stderr, "c: %s\n", filepath.Base(id.filename))
+	id.errs = make(chan error, 2)
+	Emit(Event{Event: "selected", Account: id.account, Mailbox: id.mailboxname}, "c: %s\n", filepath.Base(id.filename))
+	defer func() {
+		// blocks until the fetch goroutines gave back their clients
+		id.busy.Wait()
+		select {
+		case e := <-id.errs:
+			if err == nil {
+				err = e
+			}
+		default:
+		}
+	}()
 
 	if fetch, e := id.CompareUIDs(path_buffer); e != nil {
-		panic(e)
-	} else if fetch != nil {
-		if full, e := id.FilterCanonicalHeaders(fetch, hasher, path_buffer); e != nil {
-			panic(e)
-		} else if full != nil {
-			if e := id.HandleFullFetched(full); e != nil {
-				panic(e)
+		if fetch != nil {
+			// drain, so that the fetch goroutine can finish
+			for range fetch {
 			}
 		}
+		return e
+	} else if fetch != nil {
+		if batches, e := id.FilterCanonicalHeaders(fetch, hasher, path_buffer); e != nil {
+			return e
+		} else if e := id.FetchBatches(batches, path_buffer); e != nil {
+			return e
+		}
 	}
+	if id.options.retain > 0 && !*dry_run {
+		return id.Expire(path_buffer)
+	}
+	return nil
 }
 
 func (id *IndexData) CompareUIDs(path_buffer *bytes.Buffer) (chan *imap.Message, error) {
 	c := <-id.cc
-	if stat, e := c.Select(id.mailboxname, false); e != nil {
-		select {
-		case <-c.LoggedOut():
-			return nil, nil
-		default:
-			panic(e)
-		}
-	} else if stat.Messages == 0 {
+	var stat *imap.MailboxStatus
+	var modseq uint64
+	var e error
+	if id.condstore {
+		stat, modseq, e = SelectModseq(c, id.mailboxname, *dry_run)
+	} else {
+		stat, e = c.Select(id.mailboxname, *dry_run)
+	}
+	if e != nil {
+		id.cc <- c
+		return nil, e
+	}
+	id.CheckUidValidity(stat.UidValidity)
+	// with CONDSTORE, only changes since the last known modseq are fetched;
+	// local notmuch changes can be to any message, so all are compared
+	incremental := id.modseq != 0 && modseq != 0 && id.stale == nil && local_flags == nil
+	if stat.Messages == 0 {
 		id.indexbytes = nil
+		id.modseq = modseq
+		if id.stale != nil {
+			// nothing was found again after a UIDVALIDITY change
+			id.MarkStaleOffline(path_buffer)
+		}
+		id.cc <- c
+		return nil, nil
+	} else if incremental && modseq == id.modseq {
 		id.cc <- c
 		return nil, nil
 	}
+	since := id.modseq
+	id.modseq = modseq
 
 	uid_seq := new(imap.SeqSet)
 	if stat := c.Mailbox(); stat.Name != id.mailboxname {
+		id.cc <- c
 		return nil, fmt.Errorf("wrong mailbox selected")
 	} else {
 		uid_seq.AddRange(1, stat.Messages)
 	}
 	uid_chan := make(chan *imap.Message)
 	fetch := make(chan *imap.Message)
+	vanished := new(imap.SeqSet)
+	// uids not seen are only deleted once all were fetched
+	fetched_all := make(chan error, 1)
+	// without QRESYNC, deletions are found by UID SEARCH after the fetch
+	var uids []uint32
+	if incremental && !id.qresync {
+		uids = make([]uint32, len(id.indexbytes))
+		for k, b := range id.indexbytes {
+			uids[k] = read_uint32(b[:4])
+		}
+	}
 
+	id.busy.Add(1)
 	go func() {
+		defer id.busy.Done()
 		defer func() {
 			id.cc <- c
 		}()
 		fetch_seq := new(imap.SeqSet)
-		deleted := 0
+		fetched, changed, deleted := 0, 0, 0
+		var push, pull [5]imap.SeqSet
 		indextickets := id.GenerateIndexTickets()
 		for msg := range uid_chan {
-			if k := sort.Search(len(indextickets), func(i int) bool {
-				return msg.Uid <= uint32(indextickets[i].uid)
-			}); k == len(indextickets) {
+			if it := indextickets.Lookup(msg.Uid); it == nil {
 				// not in index, need to fetch headers
 				fetch_seq.AddNum(msg.Uid)
+				fetched++
 			} else {
-				indextickets[k].seen = true
+				it.seen = true
 				var new_flags byte
 				for _, fl := range msg.Flags {
 					switch fl {
@@ -116,162 +207,394 @@ func (id *IndexData) CompareUIDs(path_buffer *bytes.Buffer) (chan *imap.Message,
 						new_flags += 0x01 << 4
 					}
 				}
-				if new_flags != indextickets[k].flags {
-					fl := &FlagTicket{
-						old_flags: indextickets[k].flags,
-						new_flags: new_flags,
-						digest:    id.indexbytes[indextickets[k].location][4 : digest_length+4],
+				fl := &FlagTicket{
+					old_flags: it.flags,
+					new_flags: new_flags,
+					digest:    id.indexbytes[it.location][4 : digest_length+4],
+					variant:   id.indexbytes[it.location][variant_offset],
+				}
+				if local, ok := local_flags[RecordPath("", id.indexbytes[it.location][:])]; ok {
+					merged, add, remove := MergeFlags(fl.old_flags, new_flags, local)
+					for b := 0; b < len(flaglist); b++ {
+						if add&(0x01<<b) != 0 {
+							push[b].AddNum(msg.Uid)
+						} else if remove&(0x01<<b) != 0 {
+							pull[b].AddNum(msg.Uid)
+						}
 					}
-					id.indexbytes[indextickets[k].location][4+digest_length] = new_flags
+					// notmuch has the tags of local, not those of old_flags
+					fl.new_flags, fl.old_flags = merged, local&^0x04|fl.old_flags&0x04
+				}
+				if fl.new_flags != it.flags {
+					id.indexbytes[it.location][4+digest_length] = fl.new_flags
+					changed++
+				}
+				if fl.new_flags != fl.old_flags {
 					fl.WriteTo(path_buffer)
 				}
 			}
 		}
+		if e := <-fetched_all; e != nil {
+			// returned by CompareUIDs
+			close(fetch)
+			return
+		}
+		for b := range flaglist {
+			if *dry_run {
+				if !push[b].Empty() {
+					Emit(Event{Event: "push", Account: id.account, Mailbox: id.mailboxname, Count: seq_len(&push[b])}, "p %s: +%s %s\n", filepath.Base(id.filename)[:5], flaglist[b], &push[b])
+				}
+				if !pull[b].Empty() {
+					Emit(Event{Event: "push", Account: id.account, Mailbox: id.mailboxname, Count: seq_len(&pull[b])}, "p %s: -%s %s\n", filepath.Base(id.filename)[:5], flaglist[b], &pull[b])
+				}
+				continue
+			}
+			if !push[b].Empty() {
+				if e := c.UidStore(&push[b], imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{flaglist[b]}, nil); e != nil {
+					id.errs <- e
+					close(fetch)
+					return
+				}
+			}
+			if !pull[b].Empty() {
+				if e := c.UidStore(&pull[b], imap.FormatFlagsOp(imap.RemoveFlags, true), []interface{}{flaglist[b]}, nil); e != nil {
+					id.errs <- e
+					close(fetch)
+					return
+				}
+			}
+		}
 		for _, it := range indextickets {
-			if it.seen {
+			if it.seen || incremental && !vanished.Contains(it.uid) {
 				continue
 			}
 			deleted++
 			id.indexbytes[it.location][4+digest_length] = 0xff
-			path := filepath.Join(*targetdir, fmt.Sprintf("%02x", id.indexbytes[it.location][4]), fmt.Sprintf("%02x", id.indexbytes[it.location][5:digest_length+4]))
-			fmt.Fprintf(path_buffer, "+offline %s\n", path)
+			fmt.Fprintf(path_buffer, "+offline %s\n", RecordPath(*targetdir, id.indexbytes[it.location][:]))
 		}
 		if deleted > 0 {
-			if e := id.Sort(4 + digest_length); e != nil {
-				panic(e)
-			}
+			id.Sort(4 + digest_length)
 			end := sort.Search(len(id.indexbytes), func(i int) bool {
 				return id.indexbytes[i][4+digest_length] == 0xff
 			})
 			id.indexbytes = id.indexbytes[:end]
-			if e := id.Sort(5); e != nil {
-				panic(e)
-			}
+			id.Sort(5)
 		}
+		Emit(Event{Event: "new", Account: id.account, Mailbox: id.mailboxname, Count: fetched}, "")
+		Emit(Event{Event: "flags", Account: id.account, Mailbox: id.mailboxname, Count: changed}, "")
+		Emit(Event{Event: "deleted", Account: id.account, Mailbox: id.mailboxname, Count: deleted}, "")
 		if fetch_seq.Empty() {
 			close(fetch)
 			return
-		} else {
-			c.UidFetch(fetch_seq, canonical_header_fetch_items, fetch)
+		} else if e := c.UidFetch(fetch_seq, id.canonical.FetchItems(), fetch); e != nil {
+			id.errs <- e
 		}
 	}()
-	return fetch, c.Fetch(uid_seq, uid_fetch_items, uid_chan)
+	if incremental {
+		e = FetchChangedSince(c, since, id.qresync, vanished, uid_chan)
+		if e == nil && !id.qresync {
+			e = FindVanished(c, uids, vanished)
+		}
+	} else {
+		e = c.Fetch(uid_seq, uid_fetch_items, uid_chan)
+	}
+	fetched_all <- e
+	return fetch, e
 }
 
-func (id *IndexData) FilterCanonicalHeaders(fetch chan *imap.Message, hasher hash.Hash, path_buffer *bytes.Buffer) (chan *imap.Message, error) {
-	counter := 0
-	num := 0
-	full_fetch := new(imap.SeqSet)
-	for msg := range fetch {
-		if m, e := mail.ReadMessage(msg.GetBody(canonical_header_section)); e != nil {
-			continue
+// MergeFlags is the three-way merge of the flags of a message on the server
+// and in notmuch against old, the flags last known to both: a flag changed on
+// either side wins. Both sides cannot change a flag in different directions,
+// since it has only two values. It returns the merged flags, and the flags
+// to add to and remove from the server. \Deleted is never pushed: notmuch
+// has no tag for it, so the server decides.
+func MergeFlags(old byte, server byte, local byte) (merged byte, add byte, remove byte) {
+	local = local&^0x04 | old&0x04
+	merged = old ^ ((local ^ old) | (server ^ old))
+	differ := merged ^ server
+	return merged, differ & merged, differ &^ merged
+}
+
+// CheckUidValidity records the UIDVALIDITY of the selected mailbox. When it
+// differs from the one in the index file, the UIDs in the index are stale:
+// the index is emptied so that every message is matched again by its
+// canonical headers.
+func (id *IndexData) CheckUidValidity(uidvalidity uint32) {
+	if id.uidvalidity != 0 && id.uidvalidity != uidvalidity {
+		// modseqs are only comparable within one UIDVALIDITY
+		id.modseq = 0
+	}
+	if id.uidvalidity != 0 && id.uidvalidity != uidvalidity && len(id.indexbytes) > 0 {
+		Emit(Event{Event: "uidvalidity", Account: id.account, Mailbox: id.mailboxname, Count: len(id.indexbytes)}, "v %s: uidvalidity %d -> %d, rebuilding\n", filepath.Base(id.filename)[:5], id.uidvalidity, uidvalidity)
+		id.stale = make(map[string]byte, len(id.indexbytes))
+		for _, b := range id.indexbytes {
+			id.stale[RecordPath(*targetdir, b[:])] = b[digest_length+4]
+		}
+		id.indexbytes = nil
+	}
+	id.uidvalidity = uidvalidity
+}
+
+// MarkStaleOffline tags messages from before a UIDVALIDITY change which were
+// not found again as +offline.
+func (id *IndexData) MarkStaleOffline(path_buffer *bytes.Buffer) {
+	for _, b := range id.indexbytes {
+		delete(id.stale, RecordPath(*targetdir, b[:]))
+	}
+	for path := range id.stale {
+		fmt.Fprintf(path_buffer, "+offline %s\n", path)
+	}
+	id.stale = nil
+}
+
+// FilterCanonicalHeaders adds the messages of fetch to the index, and
+// returns those which need to be fully fetched, in batches of at most
+// batch_count messages and batch_mb megabytes.
+func (id *IndexData) FilterCanonicalHeaders(fetch chan *imap.Message, hasher hash.Hash, path_buffer *bytes.Buffer) ([][]uint32, error) {
+	counter, identified := 0, 0
+	// to be fully fetched, with their RFC822.SIZE
+	var full_uids, full_sizes []uint32
+	// body is only read for messages without canonical headers
+	handle := func(msg *imap.Message, headers mail.Header, body io.Reader) error {
+		if n, e := id.canonical.WriteIdentity(headers, body, hasher); e != nil {
+			return e
 		} else {
-			if n, e := WriteHeaders(m.Header, hasher); e != nil {
-				return nil, e
-			} else {
-				counter += n
-			}
-			rticket := new(ResponseTicket)
-			rticket.headers = m.Header
+			counter += n
+			identified++
+		}
+		rticket := new(ResponseTicket)
+		rticket.headers = headers
+		rticket.canonical = id.canonical
 
-			custom := make([]string, 0, 2)
-			if id.k == 1 {
-				custom = append(custom, "+sent")
-			}
+		custom := make([]string, 0, 2)
+		for _, tag := range id.options.tags {
+			custom = append(custom, "+"+tag)
+		}
 
-			for _, fl := range msg.Flags {
-				switch fl {
-				case flaglist[0]:
-					rticket.flags += 0x01
-				case flaglist[1]:
-					rticket.flags += 0x01 << 1
-				case flaglist[2]:
-					rticket.flags += 0x01 << 2
-				case flaglist[3]:
-					rticket.flags += 0x01 << 3
-				case flaglist[4]:
-					rticket.flags += 0x01 << 4
-				}
+		for _, fl := range msg.Flags {
+			switch fl {
+			case flaglist[0]:
+				rticket.flags += 0x01
+			case flaglist[1]:
+				rticket.flags += 0x01 << 1
+			case flaglist[2]:
+				rticket.flags += 0x01 << 2
+			case flaglist[3]:
+				rticket.flags += 0x01 << 3
+			case flaglist[4]:
+				rticket.flags += 0x01 << 4
 			}
-			rticket.uid = msg.Uid
-			copy(rticket.digest[:], hasher.Sum(nil))
-			hasher.Reset()
-			if e := rticket.Stat(*targetdir); e != nil {
-				// need to full fetch
-				full_fetch.AddNum(msg.Uid)
-				num++
-			}
-			fl := &FlagTicket{
-				old_flags: 0x00,
-				new_flags: rticket.flags,
-				digest:    rticket.digest[:],
-				custom:    custom,
+		}
+		rticket.uid = msg.Uid
+		rticket.size = msg.Size
+		if !msg.InternalDate.IsZero() {
+			rticket.date = uint32(msg.InternalDate.Unix())
+		}
+		copy(rticket.digest[:], hasher.Sum(nil))
+		hasher.Reset()
+		if exists, e := rticket.Stat(*targetdir); e != nil {
+			return e
+		} else if !exists {
+			// need to full fetch
+			full_uids = append(full_uids, msg.Uid)
+			full_sizes = append(full_sizes, msg.Size)
+		}
+		fl := &FlagTicket{
+			old_flags: 0x00,
+			new_flags: rticket.flags,
+			digest:    rticket.digest[:],
+			variant:   rticket.variant,
+			custom:    custom,
+		}
+		if old_flags, ok := id.stale[StorePath(*targetdir, rticket.digest[:], rticket.variant)]; ok {
+			fl.old_flags = old_flags
+		}
+		fl.WriteTo(path_buffer)
+		var t [index_record_size]byte
+		rticket.Read(t[:])
+		id.indexbytes = append(id.indexbytes, t)
+		return nil
+	}
+	anonymous := new(imap.SeqSet)
+	section := id.canonical.Section()
+	var err error
+	for msg := range fetch {
+		if err != nil {
+			// drain, so that the fetch can finish
+			continue
+		} else if r := msg.GetBody(section); r == nil {
+			anonymous.AddNum(msg.Uid)
+		} else if m, e := mail.ReadMessage(r); e != nil || !id.canonical.Has(m.Header) {
+			// identified by fallback headers and body, fetched below
+			anonymous.AddNum(msg.Uid)
+		} else if e := handle(msg, m.Header, nil); e != nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	} else if !anonymous.Empty() {
+		c := <-id.cc
+		if _, e := c.Select(id.mailboxname, *dry_run); e != nil {
+			id.cc <- c
+			return nil, e
+		}
+		fallback := make(chan *imap.Message)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(anonymous, fallback_fetch_items, fallback)
+		}()
+		for msg := range fallback {
+			if err != nil {
+				continue
+			} else if r := msg.GetBody(fallback_header_section); r == nil {
+				continue
+			} else if m, e := mail.ReadMessage(r); e != nil {
+				continue
+			} else if e := handle(msg, m.Header, msg.GetBody(text_section)); e != nil {
+				err = e
 			}
-			fl.WriteTo(path_buffer)
-			var t [digest_length + 5]byte
-			rticket.Read(t[:])
-			id.indexbytes = append(id.indexbytes, t)
 		}
+		id.cc <- c
+		if e := <-done; e != nil {
+			return nil, e
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if id.stale != nil {
+		id.MarkStaleOffline(path_buffer)
 	}
 	if counter > 0 {
-		fmt.Fprintf(os.Stderr, "h %s: %d b\n", filepath.Base(id.filename)[:5], counter)
+		Emit(Event{Event: "headers", Account: id.account, Mailbox: id.mailboxname, Bytes: counter}, "h %s: %d b\n", filepath.Base(id.filename)[:5], counter)
 		if e := id.Sort(5); e != nil {
 			return nil, e
 		}
 	}
-	if full_fetch.Empty() {
+	if *dry_run {
+		var total int
+		for _, size := range full_sizes {
+			total += int(size)
+		}
+		Emit(Event{Event: "plan", Account: id.account, Mailbox: id.mailboxname, Count: len(full_uids), Bytes: total}, "n %s: %d headers, %d full messages, %d b\n", filepath.Base(id.filename)[:5], identified, len(full_uids), total)
 		return nil, nil
 	}
+	return Batches(full_uids, full_sizes, *batch_count, *batch_mb), nil
+}
+
+// Batches splits uids into batches of at most count messages and mb
+// megabytes, given their sizes. A message larger than mb has a batch of its
+// own.
+func Batches(uids []uint32, sizes []uint32, count int, mb int) [][]uint32 {
+	var batches [][]uint32
+	var size int
+	for k, uid := range uids {
+		if n := len(batches); n == 0 || len(batches[n-1]) >= count || size+int(sizes[k]) > mb*1000000 {
+			batches = append(batches, nil)
+			size = 0
+		}
+		batches[len(batches)-1] = append(batches[len(batches)-1], uid)
+		size += int(sizes[k])
+	}
+	return batches
+}
 
+// FetchBatches fully fetches the messages of batches, one batch after the
+// other. The index is checkpointed after each batch but the last, so that
+// an interrupted run is resumed by the next one.
+func (id *IndexData) FetchBatches(batches [][]uint32, path_buffer *bytes.Buffer) error {
+	pending := make(map[uint32]bool)
+	for _, uids := range batches {
+		for _, uid := range uids {
+			pending[uid] = true
+		}
+	}
+	wb := new(bufio.Writer)
+	for k, uids := range batches {
+		seq := new(imap.SeqSet)
+		seq.AddNum(uids...)
+		if e := id.HandleFullFetched(id.FetchFull(seq)); e != nil {
+			return e
+		}
+		id.busy.Wait()
+		select {
+		case e := <-id.errs:
+			return e
+		default:
+		}
+		for _, uid := range uids {
+			delete(pending, uid)
+		}
+		if k < len(batches)-1 {
+			if e := id.Checkpoint(pending, wb, path_buffer); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// FetchFull starts fetching the full messages of full_fetch.
+func (id *IndexData) FetchFull(full_fetch *imap.SeqSet) chan *imap.Message {
 	c := <-id.cc
-	full := make(chan *imap.Message, num)
+	// go-imap holds each literal in memory, so only a few messages are
+	// fetched ahead of the archive tickets
+	full := make(chan *imap.Message, num_batons)
+	id.busy.Add(1)
 	go func() {
+		defer id.busy.Done()
+		defer func() {
+			id.cc <- c
+		}()
 		if _, e := c.Select(id.mailboxname, false); e != nil {
-			panic(e)
+			close(full)
+			id.errs <- e
 		} else if e := c.UidFetch(full_fetch, full_fetch_items, full); e != nil {
-			panic(e)
-		} else {
-			id.cc <- c
+			id.errs <- e
 		}
 	}()
-	return full, nil
+	return full
 }
 
-func (id *IndexData) HandleFullFetched(full chan *imap.Message) error {
-	c := <-id.cc
-	defer func() {
-		id.cc <- c
-	}()
+// HandleFullFetched streams the messages of full into the store. A message
+// which cannot be archived is skipped, and the first such error returned
+// after the others are written.
+func (id *IndexData) HandleFullFetched(full chan *imap.Message) (err error) {
 	tickets := make(chan *ArchiveTicket)
 	batons := make(chan *ArchiveTicket, num_batons)
+	written := make(chan error, 1)
 	go func() {
-		if count, e := HandleArchiveTickets(*targetdir, tickets); e != nil {
-			panic(e)
-		} else {
-			fmt.Fprintf(os.Stderr, "w %s: %0.4f MB\n", filepath.Base(id.filename)[:5], float64(count)/1000000)
-		}
+		count, e := HandleArchiveTickets(*targetdir, *compress || id.compress, tickets)
+		Emit(Event{Event: "written", Account: id.account, Mailbox: id.mailboxname, Bytes: count}, "w %s: %0.4f MB\n", filepath.Base(id.filename)[:5], float64(count)/1000000)
+		written <- e
 	}()
+	// the variants chosen by ResponseTicket.Stat
+	variants := make(map[uint32]byte, len(id.indexbytes))
+	for _, b := range id.indexbytes {
+		variants[read_uint32(b[:4])] = b[variant_offset]
+	}
 	for i := 0; i < num_batons; i++ {
 		a := &ArchiveTicket{
-			hasher:  sha256.New(),
-			batons:  batons,
-			tickets: tickets,
-			file:    nil,
-			msg:     new(mail.Message),
-			rb:      nil,
-			wb:      new(bufio.Writer),
+			canonical: id.canonical,
+			hasher:    sha256.New(),
+			batons:    batons,
+			tickets:   tickets,
+			notify:    id.options.notify,
+			file:      nil,
+			msg:       new(mail.Message),
+			r:         nil,
+			wb:        new(bufio.Writer),
 		}
 		batons <- a
 	}
 	for msg := range full {
 		t := <-batons
-		if body, e := io.ReadAll(msg.GetBody(full_section)); e != nil {
-			return e
-		} else if m, e := mail.ReadMessage(bytes.NewBuffer(body)); e != nil {
-			return e
+		if r := msg.GetBody(full_section); r == nil {
+			err = fmt.Errorf("uid %d: no body", msg.Uid)
+			batons <- t
 		} else {
-			t.rb = body
-			t.msg = m
+			t.r = r
+			t.variant = variants[msg.Uid]
 			t.Submit()
 		}
 	}
@@ -280,60 +603,26 @@ func (id *IndexData) HandleFullFetched(full chan *imap.Message) error {
 	}
 	close(batons)
 	close(tickets)
-	return nil
-}
-
-func (id *IndexData) SaveIndexFile(wb *bufio.Writer) error {
-	id.UidSort()
-	if f, e := os.CreateTemp(filepath.Dir(id.filename), filepath.Base(id.filename)); e != nil {
+	if e := <-written; e != nil {
 		return e
-	} else {
-		wb.Reset(f)
-		for _, id := range id.indexbytes {
-			wb.Write(id[:])
-		}
-		if e := wb.Flush(); e != nil {
-			return e
-		} else if e := f.Close(); e != nil {
-			return e
-		} else if e := os.Rename(f.Name(), id.filename); e != nil {
-			return e
-		}
 	}
-	return nil
+	return err
 }
 
-func (id *IndexData) Disconnect() error {
-	c := <-id.cc
-	select {
-	case <-c.LoggedOut():
-		id.cc <- c
-		return nil
-	default:
-	}
-	if e := c.Logout(); e != nil {
-		return e
-	} else {
+// Disconnect logs out the clients of the account of id.
+func (id *IndexData) Disconnect() (err error) {
+	for k := 0; k < cap(id.cc); k++ {
+		c := <-id.cc
+		select {
+		case <-c.LoggedOut():
+		default:
+			if e := c.Logout(); e != nil {
+				err = e
+			}
+		}
 		id.cc <- c
 	}
-	return nil
-}
-
-func (id *IndexData) ReadIndexFile() (e error) {
-	var rb *bufio.Reader
-	if f, e := os.Open(id.filename); e != nil {
-		return e
-	} else if i, e := f.Stat(); e != nil {
-		return e
-	} else {
-		defer f.Close()
-		rb = bufio.NewReaderSize(f, int(i.Size()))
-		id.indexbytes = make([][digest_length + 5]byte, int(i.Size())/(digest_length+4+1))
-	}
-	for k := 0; k < len(id.indexbytes); k++ {
-		rb.Read(id.indexbytes[k][:])
-	}
-	return nil
+	return err
 }
 
 func (id *IndexData) Sort(start int) error {
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeFlags(t *testing.T) {
+	const seen, answered, deleted, forwarded, flagged = 0x01, 0x02, 0x04, 0x08, 0x10
+	for _, tc := range []struct {
+		name                string
+		old, server, local  byte
+		merged, add, remove byte
+	}{
+		{"unchanged", seen, seen, seen, seen, 0, 0},
+		{"read locally", 0, 0, seen, seen, seen, 0},
+		{"read on the server", 0, seen, 0, seen, 0, 0},
+		{"unread locally", seen, seen, 0, 0, 0, seen},
+		{"unread on the server", seen, 0, seen, 0, 0, 0},
+		{"both read", 0, seen, seen, seen, 0, 0},
+		{"flagged locally, answered on the server", seen, seen | answered, seen | flagged, seen | answered | flagged, flagged, 0},
+		{"server and local both change", seen | flagged, flagged | forwarded, seen, forwarded, 0, flagged},
+		{"deleted on the server", seen, seen | deleted, seen, seen | deleted, 0, 0},
+		{"deleted is not pushed", seen, seen, seen | deleted, seen, 0, 0},
+		{"deleted is not pulled", seen | deleted, seen | deleted, seen, seen | deleted, 0, 0},
+	} {
+		merged, add, remove := MergeFlags(tc.old, tc.server, tc.local)
+		if merged != tc.merged || add != tc.add || remove != tc.remove {
+			t.Errorf("%s: got %#x +%#x -%#x, want %#x +%#x -%#x", tc.name, merged, add, remove, tc.merged, tc.add, tc.remove)
+		}
+	}
+}
+
+func TestCheckUidValidity(t *testing.T) {
+	id := &IndexData{filename: "abcdefgh", uidvalidity: 1, modseq: 42}
+	id.CheckUidValidity(1)
+	if id.modseq != 42 {
+		t.Errorf("same uidvalidity: modseq %d, want 42", id.modseq)
+	}
+	// an empty index still needs a full sync
+	id.CheckUidValidity(2)
+	if id.modseq != 0 || id.uidvalidity != 2 {
+		t.Errorf("new uidvalidity: modseq %d, uidvalidity %d", id.modseq, id.uidvalidity)
+	} else if id.stale != nil {
+		t.Errorf("new uidvalidity: stale set for an empty index")
+	}
+
+	id.indexbytes = make([][index_record_size]byte, 1)
+	id.modseq = 7
+	id.CheckUidValidity(3)
+	if id.modseq != 0 || len(id.indexbytes) != 0 || len(id.stale) != 1 {
+		t.Errorf("new uidvalidity: modseq %d, %d records, %d stale", id.modseq, len(id.indexbytes), len(id.stale))
+	}
+}
+
+func TestBatches(t *testing.T) {
+	const mb = 1000000
+	for _, tc := range []struct {
+		name      string
+		sizes     []uint32
+		count, mb int
+		want      [][]uint32
+	}{
+		{"none", nil, 2, 1, nil},
+		{"by count", []uint32{1, 1, 1, 1, 1}, 2, 1, [][]uint32{{1, 2}, {3, 4}, {5}}},
+		{"by size", []uint32{mb / 2, mb / 2, mb / 2}, 10, 1, [][]uint32{{1, 2}, {3}}},
+		{"too large", []uint32{1, 3 * mb, 1}, 10, 1, [][]uint32{{1}, {2}, {3}}},
+		{"too large first", []uint32{3 * mb, 1, 1}, 10, 1, [][]uint32{{1}, {2, 3}}},
+	} {
+		uids := make([]uint32, len(tc.sizes))
+		for k := range uids {
+			uids[k] = uint32(k + 1)
+		}
+		if got := Batches(uids, tc.sizes, tc.count, tc.mb); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
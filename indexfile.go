@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Index file layout, all integers little endian:
+//
+//	0  magic "IAIX"
+//	4  format version
+//	5  digest algorithm
+//	6  record size (uint16)
+//	8  header size (uint16), including extension bytes
+//	10 reserved
+//	12 CRC-32 (IEEE) of everything from byte 16 to the end of the file
+//	16 UIDVALIDITY (uint32)
+//	20 HIGHESTMODSEQ (uint64)
+//	28 number of records (uint32)
+//	32 extension bytes, up to the header size
+//
+// Each extension is a tag byte, a length (uint16) and that many bytes:
+//
+//	1  canonical headers, comma separated; Message-ID if absent
+//	2  mailbox name
+//	3  IMAP server of the account
+//	4  MAILBOXID (RFC 8474) of the mailbox, if the server has one
+//
+// followed by the records: uid (uint32), digest, flags, INTERNALDATE (uint32
+// unix seconds, zero if unknown), variant. Version 1 records end after the
+// flags, version 2 records after the INTERNALDATE.
+//
+// Files without the magic are legacy: a bare list of version 1 records, the
+// first of which may carry the UIDVALIDITY and HIGHESTMODSEQ under uid 0.
+var index_magic = []byte("IAIX")
+
+const index_version = 3
+const index_header_size = 32
+const index_record_size = digest_length + 10
+const variant_offset = digest_length + 9
+const legacy_record_size = digest_length + 5
+
+// sha256, truncated to digest_length
+const digest_sha256 = 1
+
+// extension tags
+const ext_canonical = 1
+const ext_mailbox = 2
+const ext_addr = 3
+const ext_objectid = 4
+
+var ErrIndexFormat = fmt.Errorf("invalid index file")
+
+func (id *IndexData) ReadIndexFile() error {
+	b, e := os.ReadFile(id.filename)
+	if e != nil {
+		return e
+	}
+	if !bytes.HasPrefix(b, index_magic) {
+		return id.ParseLegacyIndex(b)
+	}
+	if len(b) < index_header_size {
+		return fmt.Errorf("%w: %s: truncated header", ErrIndexFormat, id.filename)
+	}
+	header_size := int(b[8]) + int(b[9])*256
+	record_size := int(b[6]) + int(b[7])*256
+	count := int(read_uint32(b[28:32]))
+	switch {
+	case b[4] > index_version:
+		return fmt.Errorf("%w: %s: unsupported version %d", ErrIndexFormat, id.filename, b[4])
+	case b[5] != digest_sha256:
+		return fmt.Errorf("%w: %s: unsupported digest algorithm %d", ErrIndexFormat, id.filename, b[5])
+	case record_size < legacy_record_size || record_size > index_record_size:
+		return fmt.Errorf("%w: %s: record size %d", ErrIndexFormat, id.filename, record_size)
+	case header_size < index_header_size || len(b) != header_size+count*record_size:
+		return fmt.Errorf("%w: %s: truncated", ErrIndexFormat, id.filename)
+	case crc32.ChecksumIEEE(b[16:]) != read_uint32(b[12:16]):
+		return fmt.Errorf("%w: %s: checksum mismatch", ErrIndexFormat, id.filename)
+	}
+	id.uidvalidity = read_uint32(b[16:20])
+	id.modseq = read_uint64(b[20:28])
+	id.canonical = canonical_header_list
+	for ext := b[index_header_size:header_size]; len(ext) > 0; {
+		if len(ext) < 3 || len(ext) < 3+int(ext[1])+int(ext[2])*256 {
+			return fmt.Errorf("%w: %s: truncated extension", ErrIndexFormat, id.filename)
+		}
+		value := ext[3 : 3+int(ext[1])+int(ext[2])*256]
+		switch ext[0] {
+		case ext_canonical:
+			id.canonical = ParseCanonical(string(value))
+		case ext_mailbox:
+			// the name the mailbox had, unless the caller knows it
+			if id.mailboxname == "" {
+				id.mailboxname = string(value)
+			}
+		case ext_addr:
+			if id.addr == "" {
+				id.addr = string(value)
+			}
+		case ext_objectid:
+			if id.objectid == "" {
+				id.objectid = string(value)
+			}
+		}
+		ext = ext[3+len(value):]
+	}
+	id.indexbytes = make([][index_record_size]byte, count)
+	for k := range id.indexbytes {
+		copy(id.indexbytes[k][:], b[header_size+k*record_size:header_size+(k+1)*record_size])
+	}
+	return nil
+}
+
+// ParseLegacyIndex reads an index file written before the header existed.
+func (id *IndexData) ParseLegacyIndex(b []byte) error {
+	if len(b)%legacy_record_size != 0 {
+		return fmt.Errorf("%w: %s: size %d is not a multiple of %d", ErrIndexFormat, id.filename, len(b), legacy_record_size)
+	}
+	id.indexbytes = make([][index_record_size]byte, len(b)/legacy_record_size)
+	for k := range id.indexbytes {
+		copy(id.indexbytes[k][:], b[k*legacy_record_size:(k+1)*legacy_record_size])
+	}
+	// the header record has uid 0, which is never a valid uid
+	if len(id.indexbytes) > 0 && read_uint32(id.indexbytes[0][:4]) == 0 {
+		id.uidvalidity = read_uint32(id.indexbytes[0][4:8])
+		id.modseq = read_uint64(id.indexbytes[0][8:16])
+		id.indexbytes = id.indexbytes[1:]
+	}
+	id.canonical = canonical_header_list
+	return nil
+}
+
+func (id *IndexData) WriteIndex(w io.Writer) error {
+	canonical := id.canonical
+	if canonical == nil {
+		canonical = canonical_header_list
+	}
+	var ext []byte
+	for _, x := range []struct {
+		tag   byte
+		value string
+	}{
+		{ext_canonical, canonical.String()},
+		{ext_mailbox, id.mailboxname},
+		{ext_addr, id.addr},
+		{ext_objectid, id.objectid},
+	} {
+		if x.value != "" || x.tag == ext_canonical {
+			ext = append(ext, x.tag, byte(len(x.value)%256), byte(len(x.value)/256))
+			ext = append(ext, x.value...)
+		}
+	}
+	header := make([]byte, index_header_size, index_header_size+len(ext))
+	header = append(header, ext...)
+	copy(header[:4], index_magic)
+	header[4] = index_version
+	header[5] = digest_sha256
+	header[6], header[7] = byte(index_record_size%256), byte(index_record_size/256)
+	header[8], header[9] = byte(len(header)%256), byte(len(header)/256)
+	put_uint32(header[16:20], id.uidvalidity)
+	put_uint64(header[20:28], id.modseq)
+	put_uint32(header[28:32], uint32(len(id.indexbytes)))
+
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[16:])
+	for _, b := range id.indexbytes {
+		checksum.Write(b[:])
+	}
+	put_uint32(header[12:16], checksum.Sum32())
+
+	if _, e := w.Write(header[:]); e != nil {
+		return e
+	}
+	for _, b := range id.indexbytes {
+		if _, e := w.Write(b[:]); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// Checkpoint saves the index of id without the records of the pending
+// UIDs, whose messages are not archived yet. Without a modseq, the next run
+// compares all UIDs and so finds them again. The tag lines of path_buffer are
+// saved first: the next run finds no changes for the saved records, so they
+// would be lost if the mailbox failed before notmuch got them.
+func (id *IndexData) Checkpoint(pending map[uint32]bool, wb *bufio.Writer, path_buffer *bytes.Buffer) error {
+	if e := id.SavePendingTags(path_buffer); e != nil {
+		return e
+	}
+	saved := &IndexData{filename: id.filename, mailboxname: id.mailboxname, addr: id.addr, objectid: id.objectid, uidvalidity: id.uidvalidity, canonical: id.canonical}
+	for _, b := range id.indexbytes {
+		if !pending[read_uint32(b[:4])] {
+			saved.indexbytes = append(saved.indexbytes, b)
+		}
+	}
+	return saved.SaveIndexFile(wb)
+}
+
+// the notmuch tag lines of a saved index or checkpoint are kept next to
+// it, until notmuch has them
+const tags_suffix = ".tags"
+
+func (id *IndexData) SavePendingTags(path_buffer *bytes.Buffer) error {
+	tmp := id.filename + tags_suffix + ".tmp"
+	if e := os.WriteFile(tmp, path_buffer.Bytes(), 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, id.filename+tags_suffix)
+}
+
+// ReadPendingTags adds the tag lines of an earlier checkpoint, if any, to
+// path_buffer.
+func (id *IndexData) ReadPendingTags(path_buffer *bytes.Buffer) error {
+	if b, e := os.ReadFile(id.filename + tags_suffix); os.IsNotExist(e) {
+		return nil
+	} else if e != nil {
+		return e
+	} else {
+		path_buffer.Write(b)
+		return nil
+	}
+}
+
+func (id *IndexData) RemovePendingTags() error {
+	if e := os.Remove(id.filename + tags_suffix); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return nil
+}
+
+func (id *IndexData) SaveIndexFile(wb *bufio.Writer) error {
+	id.UidSort()
+	if f, e := os.CreateTemp(filepath.Dir(id.filename), ".tmp_"+filepath.Base(id.filename)); e != nil {
+		return e
+	} else {
+		wb.Reset(f)
+		if e := id.WriteIndex(wb); e != nil {
+			f.Close()
+			return e
+		} else if e := wb.Flush(); e != nil {
+			f.Close()
+			return e
+		} else if e := f.Close(); e != nil {
+			return e
+		} else if e := os.Rename(f.Name(), id.filename); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// MigrateIndex rewrites every index file in dir in the current format.
+func MigrateIndex(dir string) error {
+	entries, e := os.ReadDir(dir)
+	if e != nil {
+		return e
+	}
+	wb := new(bufio.Writer)
+	for _, entry := range entries {
+		if entry.IsDir() || !IsIndexName(entry.Name()) {
+			// mailbox ids are eight characters
+			continue
+		}
+		id := &IndexData{filename: filepath.Join(dir, entry.Name())}
+		if e := id.ReadIndexFile(); e != nil {
+			return e
+		} else if e := id.SaveIndexFile(wb); e != nil {
+			return e
+		}
+		fmt.Fprintf(os.Stderr, "m %s: %d records\n", entry.Name(), len(id.indexbytes))
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testRecord(uid uint32, fill byte, flags byte, variant byte) (b [index_record_size]byte) {
+	put_uint32(b[:4], uid)
+	for k := 4; k < digest_length+4; k++ {
+		b[k] = fill
+	}
+	b[digest_length+4] = flags
+	put_uint32(b[digest_length+5:digest_length+9], 1700000000+uid)
+	b[variant_offset] = variant
+	return b
+}
+
+func writeTestIndex(t *testing.T, id *IndexData) []byte {
+	t.Helper()
+	if e := id.SaveIndexFile(new(bufio.Writer)); e != nil {
+		t.Fatal(e)
+	}
+	b, e := os.ReadFile(id.filename)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return b
+}
+
+func TestIndexRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	for name, id := range map[string]*IndexData{
+		"empty": {},
+		"records": {
+			uidvalidity: 42,
+			modseq:      1 << 40,
+			indexbytes:  [][index_record_size]byte{testRecord(3, 0xaa, 0x01, 0), testRecord(9, 0xbb, 0x13, 2)},
+		},
+		"extensions": {
+			mailboxname: "[Gmail]/Sent Mail",
+			addr:        "imap.example.com:993",
+			objectid:    "F2212ea87-6097-4256-9d51-71338625",
+			canonical:   Canonical{"Message-ID", "Date"},
+			uidvalidity: 7,
+			indexbytes:  [][index_record_size]byte{testRecord(1, 0x01, 0, 0)},
+		},
+	} {
+		id.filename = filepath.Join(dir, name)
+		writeTestIndex(t, id)
+		got := &IndexData{filename: id.filename}
+		if e := got.ReadIndexFile(); e != nil {
+			t.Fatalf("%s: %s", name, e)
+		}
+		want := id.canonical
+		if want == nil {
+			want = canonical_header_list
+		}
+		switch {
+		case got.uidvalidity != id.uidvalidity || got.modseq != id.modseq:
+			t.Errorf("%s: uidvalidity %d modseq %d, want %d %d", name, got.uidvalidity, got.modseq, id.uidvalidity, id.modseq)
+		case got.mailboxname != id.mailboxname || got.addr != id.addr || got.objectid != id.objectid:
+			t.Errorf("%s: extensions %q %q %q", name, got.mailboxname, got.addr, got.objectid)
+		case got.canonical.String() != want.String():
+			t.Errorf("%s: canonical %s, want %s", name, got.canonical, want)
+		case len(got.indexbytes) != len(id.indexbytes) || len(id.indexbytes) > 0 && !reflect.DeepEqual(got.indexbytes, id.indexbytes):
+			t.Errorf("%s: records differ", name)
+		}
+	}
+}
+
+func TestIndexKeepsKnownName(t *testing.T) {
+	id := &IndexData{filename: filepath.Join(t.TempDir(), "abcdefgh"), mailboxname: "Old", addr: "a:993"}
+	writeTestIndex(t, id)
+	got := &IndexData{filename: id.filename, mailboxname: "New"}
+	if e := got.ReadIndexFile(); e != nil {
+		t.Fatal(e)
+	} else if got.mailboxname != "New" || got.addr != "a:993" {
+		t.Errorf("got %q %q", got.mailboxname, got.addr)
+	}
+}
+
+func TestLegacyIndex(t *testing.T) {
+	dir := t.TempDir()
+	r1, r2 := testRecord(5, 0x11, 0x01, 0), testRecord(6, 0x22, 0x10, 0)
+	var header [index_record_size]byte
+	put_uint32(header[4:8], 99)
+	put_uint64(header[8:16], 1234)
+	for _, tc := range []struct {
+		name        string
+		records     [][index_record_size]byte
+		uidvalidity uint32
+		modseq      uint64
+		want        int
+		err         bool
+	}{
+		{"plain", [][index_record_size]byte{r1, r2}, 0, 0, 2, false},
+		{"header", [][index_record_size]byte{header, r1, r2}, 99, 1234, 2, false},
+		{"empty", nil, 0, 0, 0, false},
+	} {
+		var b []byte
+		for _, r := range tc.records {
+			b = append(b, r[:legacy_record_size]...)
+		}
+		filename := filepath.Join(dir, tc.name)
+		if e := os.WriteFile(filename, b, 0644); e != nil {
+			t.Fatal(e)
+		}
+		id := &IndexData{filename: filename}
+		if e := id.ReadIndexFile(); e != nil {
+			t.Errorf("%s: %s", tc.name, e)
+		} else if len(id.indexbytes) != tc.want || id.uidvalidity != tc.uidvalidity || id.modseq != tc.modseq {
+			t.Errorf("%s: %d records, uidvalidity %d modseq %d", tc.name, len(id.indexbytes), id.uidvalidity, id.modseq)
+		} else if tc.want > 0 && read_uint32(id.indexbytes[0][:4]) != 5 || tc.want > 1 && id.indexbytes[1][digest_length+4] != 0x10 {
+			t.Errorf("%s: records differ", tc.name)
+		}
+	}
+	// records cut short are not mistaken for an index
+	filename := filepath.Join(dir, "short")
+	if e := os.WriteFile(filename, r1[:legacy_record_size-1], 0644); e != nil {
+		t.Fatal(e)
+	} else if e := (&IndexData{filename: filename}).ReadIndexFile(); !errors.Is(e, ErrIndexFormat) {
+		t.Errorf("short: %v", e)
+	}
+}
+
+func TestIndexCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	id := &IndexData{
+		filename:    filepath.Join(dir, "good"),
+		mailboxname: "INBOX",
+		uidvalidity: 1,
+		indexbytes:  [][index_record_size]byte{testRecord(1, 0x01, 0, 0), testRecord(2, 0x02, 0, 0)},
+	}
+	good := writeTestIndex(t, id)
+	header_size := int(good[8]) + int(good[9])*256
+	for _, tc := range []struct {
+		name   string
+		mangle func([]byte) []byte
+	}{
+		{"truncated header", func(b []byte) []byte { return b[:20] }},
+		{"truncated extension", func(b []byte) []byte { return b[:header_size-1] }},
+		{"truncated record", func(b []byte) []byte { return b[:len(b)-1] }},
+		{"extra bytes", func(b []byte) []byte { return append(b, 0) }},
+		{"record checksum", func(b []byte) []byte { b[len(b)-3] ^= 0xff; return b }},
+		{"uidvalidity checksum", func(b []byte) []byte { b[16]++; return b }},
+		{"extension checksum", func(b []byte) []byte { b[index_header_size+3] ^= 0x20; return b }},
+		{"version", func(b []byte) []byte { b[4] = index_version + 1; return b }},
+		{"digest", func(b []byte) []byte { b[5] = 0; return b }},
+		{"record size", func(b []byte) []byte { b[6] = index_record_size + 1; return b }},
+		{"extension length", func(b []byte) []byte {
+			b[index_header_size+1] = 0xff
+			put_uint32(b[12:16], crc32.ChecksumIEEE(b[16:]))
+			return b
+		}},
+	} {
+		filename := filepath.Join(dir, "bad")
+		if e := os.WriteFile(filename, tc.mangle(append([]byte(nil), good...)), 0644); e != nil {
+			t.Fatal(e)
+		}
+		if e := (&IndexData{filename: filename}).ReadIndexFile(); !errors.Is(e, ErrIndexFormat) {
+			t.Errorf("%s: %v", tc.name, e)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	id := &IndexData{
+		filename:    filepath.Join(t.TempDir(), "abcdefgh"),
+		uidvalidity: 5,
+		modseq:      99,
+		indexbytes:  [][index_record_size]byte{testRecord(1, 0x01, 0, 0), testRecord(2, 0x02, 0, 0), testRecord(3, 0x03, 0, 0)},
+	}
+	tags := bytes.NewBufferString("+inbox /mail/01/0101\n")
+	// uid 2 is not fully fetched yet
+	if e := id.Checkpoint(map[uint32]bool{2: true}, new(bufio.Writer), tags); e != nil {
+		t.Fatal(e)
+	}
+	got := &IndexData{filename: id.filename}
+	if e := got.ReadIndexFile(); e != nil {
+		t.Fatal(e)
+	}
+	if want := [][index_record_size]byte{id.indexbytes[0], id.indexbytes[2]}; !reflect.DeepEqual(got.indexbytes, want) {
+		t.Errorf("records: got %d, want 1 and 3", len(got.indexbytes))
+	} else if got.uidvalidity != 5 || got.modseq != 0 {
+		// the modseq only holds once every change is in the index
+		t.Errorf("uidvalidity %d modseq %d, want 5 0", got.uidvalidity, got.modseq)
+	} else if len(id.indexbytes) != 3 {
+		t.Errorf("checkpoint changed the index in memory")
+	}
+	if b, e := os.ReadFile(id.filename + tags_suffix); e != nil {
+		t.Error(e)
+	} else if string(b) != tags.String() {
+		t.Errorf("tags: got %q, want %q", b, tags)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"strings"
 )
 
 func GenerateMailboxID(mailbox string, addr string, salt []byte) string {
@@ -14,3 +15,9 @@ func GenerateMailboxID(mailbox string, addr string, salt []byte) string {
 	// should be eight characters
 	return base64.URLEncoding.EncodeToString(hw.Sum(nil)[:6])
 }
+
+// IsIndexName reports whether name is an index file name as returned by
+// GenerateMailboxID, and not e.g. its .tags file or a temporary file.
+func IsIndexName(name string) bool {
+	return len(name) == 8 && strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") == ""
+}
@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestIsIndexName(t *testing.T) {
+	if name := GenerateMailboxID("INBOX", "imap.example.com:993", []byte("salt")); !IsIndexName(name) {
+		t.Errorf("%s: not an index name", name)
+	}
+	for _, name := range []string{"", "abcdefg", "abcdefghi", "abcdefg.", "abcdefgh.tags", ".tmp_idx"} {
+		if IsIndexName(name) {
+			t.Errorf("%q: index name", name)
+		}
+	}
+}
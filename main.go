@@ -8,16 +8,36 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 const digest_length = 20
 const num_batons = 4
 
+// exit status, besides 0 on success
+const exit_failed = 1 // an account or mailbox failed, or verify found problems
+const exit_usage = 2
+
 var indexdir = flag.String("index", "mail/.index", "index file directory")
 var targetdir = flag.String("t", "mail/target", "target directory")
 var portable = flag.Bool("p", false, "portable (not relative HOME)")
 var printauth = flag.Bool("auth", false, "print out AUTH information")
 var no_notmuch = flag.Bool("no-notmuch", false, "do not call notmuch")
+var push_flags = flag.Bool("push-flags", false, "push local notmuch tag changes to the server")
+var daemon = flag.Bool("daemon", false, "keep running and IDLE on the folders of each account, one per connection; folders beyond the connections of an account are only synced every -poll")
+var compress = flag.Bool("z", false, "gzip newly archived messages")
+var repair = flag.Bool("repair", false, "verify: re-fetch broken messages of the accounts on stdin, remove temporary files")
+var poll = flag.Duration("poll", 15*time.Minute, "in daemon mode, sync all folders at least this often")
+var batch_count = flag.Int("batch", 1000, "fully fetch at most this many messages at once, saving the index in between")
+var batch_mb = flag.Int("batch-mb", 500, "fully fetch at most this many megabytes at once, saving the index in between; each message is held in memory while it is stored")
+var config_file = flag.String("config", "", "json file listing the accounts, instead of their lines on stdin")
+var dry_run = flag.Bool("dry-run", false, "only report what a sync would fetch and tag, without writing the store, the index or notmuch")
+var log_format = flag.String("log-format", "text", "progress output on stderr: text, or json for one event per line")
+var summary_file = flag.String("summary", "", "write a json summary of the run to this file after every sync")
+
+// notmuch flags, keyed by store path relative to targetdir; nil unless
+// push_flags is set
+var local_flags map[string]byte
 
 func main() {
 	flag.Parse()
@@ -25,7 +45,7 @@ func main() {
 	// initialize portable directories
 	if !*portable {
 		if s, e := os.UserHomeDir(); e != nil {
-			panic(e)
+			Fatal(e)
 		} else {
 			*targetdir = filepath.Join(s, *targetdir)
 			*indexdir = filepath.Join(s, *indexdir)
@@ -34,50 +54,110 @@ func main() {
 
 	// initialize index directory
 	if e := os.MkdirAll(*indexdir, os.ModePerm); e != nil {
-		panic(e)
+		Fatal(e)
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "migrate-index":
+		if e := MigrateIndex(*indexdir); e != nil {
+			Fatal(e)
+		}
+		return
+	case "export-maildir":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: imap-archive export-maildir <maildir> {<mailbox id> | <config> <mailbox>}")
+			os.Exit(exit_usage)
+		} else if index, e := ResolveIndex(flag.Args()[2:]); e != nil {
+			Fatal(e)
+		} else if e := ExportMaildir(index, flag.Arg(1)); e != nil {
+			Fatal(e)
+		}
+		return
+	case "export-mbox":
+		var index string
+		if flag.NArg() < 2 {
+			fmt.Fprintln(os.Stderr, "usage: imap-archive export-mbox <mbox> [<mailbox id> | <config> <mailbox>]")
+			os.Exit(exit_usage)
+		} else if flag.NArg() > 2 {
+			if tmp, e := ResolveIndex(flag.Args()[2:]); e != nil {
+				Fatal(e)
+			} else {
+				index = tmp
+			}
+		}
+		if e := ExportMbox(index, flag.Arg(1)); e != nil {
+			Fatal(e)
+		}
+		return
+	case "restore":
+		if flag.NArg() < 4 {
+			fmt.Fprintln(os.Stderr, "usage: imap-archive restore <config> <folder> {<mailbox id> | <config> <mailbox>}")
+			os.Exit(exit_usage)
+		} else if index, e := ResolveIndex(flag.Args()[3:]); e != nil {
+			Fatal(e)
+		} else if conf, e := HandleConfInit(flag.Args()[1:3]); e != nil {
+			Fatal(e)
+		} else if e := Restore(index, conf, flag.Arg(2)); e != nil {
+			Fatal(e)
+		}
+		return
+	case "verify":
+		if problems, e := Verify(*indexdir, *targetdir); e != nil {
+			Fatal(e)
+		} else if problems > 0 {
+			fmt.Fprintf(os.Stderr, "v: %d problems\n", problems)
+			os.Exit(exit_failed)
+		}
+		return
+	case "rehash":
+		if e := Rehash(); e != nil {
+			Fatal(e)
+		}
+		return
+	case "recompress":
+		if e := Recompress(*targetdir); e != nil {
+			Fatal(e)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", flag.Arg(0))
+		os.Exit(exit_usage)
 	}
 
-	conf_paths, size := ParseConfInit(os.Stdin)
+	accounts, e := ReadAccounts(os.Stdin)
+	if e != nil {
+		Fatal(e)
+	}
+	var size int
+	for _, ac := range accounts {
+		size += len(ac.Folders)
+	}
 
 	// at the very end, update notmuch tags
 	// write valid paths which will contain messages to path_buffer
 	// one on each line
 
-	sorted_index_chan := make(chan *IndexData, size)
+	// filled by the goroutine below, complete once index_wg is done;
+	// discovered folders may add to size
+	ids := make([]*IndexData, 0, size)
 
 	// first in last out
 	if !*printauth {
 		defer func() {
-			// no idle
-			disconnect_chan := make(chan *IndexData, size)
-			path_buffer := bytes.NewBuffer(nil)
-			wb := new(bufio.Writer)
-			for id := range sorted_index_chan {
-				id.ForceUpdate(path_buffer)
-				// blocks until done
-				c := <-id.cc
-
-				// save index file
-				if e := id.SaveIndexFile(wb); e != nil {
-					panic(e)
-				}
-				// puts back into chan in case someone else needs client
-				id.cc <- c
-				disconnect_chan <- id
-			}
-
-			if !*no_notmuch {
-				if e := UpdateNotmuch(path_buffer); e != nil {
-					panic(e)
-				}
+			// errors are reported by Sync
+			Sync(ids)
+			if *daemon {
+				Daemon(ids)
 			}
-
-			close(disconnect_chan)
-			for id := range disconnect_chan {
+			for _, id := range ids {
 				if e := id.Disconnect(); e != nil {
-					panic(e)
+					EmitError(id.account, "", e)
 				}
 			}
+			if ReportFailures(os.Stderr) > 0 {
+				os.Exit(exit_failed)
+			}
 		}()
 	}
 
@@ -89,16 +169,15 @@ func main() {
 		defer index_wg.Done()
 		for id := range unsorted_index_chan {
 			id.Sort(5) // sort on the 5th byte
-			sorted_index_chan <- id
+			ids = append(ids, id)
 		}
-		close(sorted_index_chan)
 	}()
 	defer index_wg.Wait()
 
-	config_chan := make(chan *Config, len(conf_paths))
-	for _, cp := range conf_paths {
-		if c, e := HandleConfInit(cp); e != nil {
-			fmt.Fprintf(os.Stderr, e.Error())
+	config_chan := make(chan *Config, len(accounts))
+	for _, ac := range accounts {
+		if c, e := OpenAccount(ac); e != nil {
+			EmitError("", "", e)
 		} else {
 			config_chan <- c
 		}
@@ -111,12 +190,110 @@ func main() {
 		go func(conf *Config) {
 			defer mwg.Done()
 			if cc, e := conf.InitClient(); e != nil {
-				panic(e)
+				EmitError(conf.Name(), "", e)
 			} else {
-				InitHandler(cc, conf, unsorted_index_chan)
+				if e := InitHandler(cc, conf, unsorted_index_chan); e != nil {
+					EmitError(conf.account, "", e)
+				}
 			}
 		}(conf)
 	}
 	mwg.Wait()
 	close(unsorted_index_chan)
 }
+
+// Fatal reports e and exits. A panic would exit with exit_usage.
+func Fatal(e error) {
+	fmt.Fprintln(os.Stderr, e)
+	os.Exit(exit_failed)
+}
+
+// Sync updates every mailbox, saves the index files and then updates notmuch.
+// A mailbox which fails is reported, and its index file is left as it was.
+// The tag lines of a mailbox are saved along with its index, and kept until
+// notmuch has them, so that the index never gets ahead of notmuch.
+func Sync(ids []*IndexData) (err error) {
+	defer func() {
+		if err != nil {
+			EmitError("", "", err)
+		}
+		if *summary_file == "" {
+			return
+		} else if e := WriteSummary(*summary_file); e != nil && err == nil {
+			err = e
+		}
+	}()
+	path_buffer := bytes.NewBuffer(nil)
+	wb := new(bufio.Writer)
+	if *push_flags && !*no_notmuch {
+		// otherwise tags notmuch missed would look like local changes
+		if e := ApplyPendingTags(ids); e != nil {
+			return e
+		} else if m, e := LocalFlags(*targetdir); e != nil {
+			return e
+		} else {
+			local_flags = m
+		}
+	}
+	// mailboxes run in parallel, as far as their account has connections
+	bufs := make([]*bytes.Buffer, len(ids))
+	var wg sync.WaitGroup
+	for k, id := range ids {
+		bufs[k] = bytes.NewBuffer(nil)
+		wg.Add(1)
+		go func(id *IndexData, buf *bytes.Buffer) {
+			defer wg.Done()
+			if id.err = id.Update(buf); id.err != nil {
+				EmitError(id.account, id.mailboxname, id.err)
+			}
+		}(id, bufs[k])
+	}
+	wg.Wait()
+	for k, id := range ids {
+		// notmuch only learns about mailboxes which succeeded
+		if id.err == nil {
+			path_buffer.Write(bufs[k].Bytes())
+		}
+	}
+	// moves touch the index of the target mailbox too
+	if *dry_run {
+		// the tags notmuch would get
+		_, e := path_buffer.WriteTo(os.Stdout)
+		return e
+	}
+	for _, id := range ids {
+		if id.err == nil && id.options.archive > 0 {
+			if id.err = id.Retry(func() error { return id.Archive(ids) }); id.err != nil {
+				EmitError(id.account, id.mailboxname, id.err)
+			}
+		}
+	}
+	for k, id := range ids {
+		if id.err != nil {
+			continue
+		} else if id.err = id.SavePendingTags(bufs[k]); id.err != nil {
+			EmitError(id.account, id.mailboxname, id.err)
+		} else if id.err = id.SaveIndexFile(wb); id.err != nil {
+			EmitError(id.account, id.mailboxname, id.err)
+		}
+	}
+
+	if !*no_notmuch {
+		ev := Event{Event: "notmuch", Count: bytes.Count(path_buffer.Bytes(), []byte{'\n'})}
+		if e := UpdateNotmuch(path_buffer); e != nil {
+			ev.Error = e.Error()
+			Emit(ev, "")
+			return e
+		}
+		Emit(ev, "")
+	}
+	// notmuch has the tags now
+	for _, id := range ids {
+		if id.err != nil {
+			continue
+		} else if e := id.RemovePendingTags(); e != nil {
+			EmitError(id.account, id.mailboxname, e)
+		}
+	}
+	return nil
+}
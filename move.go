@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// Without UIDPLUS, EXPUNGE would remove every message marked \Deleted,
+// including those of the user, so nothing is expunged. Archive and Expire
+// report it, but the mailbox is synced all the same.
+var ErrNoUidplus = fmt.Errorf("server does not support UIDPLUS, not expunging")
+
+// UidExpunge expunges the messages in seq, which must be marked \Deleted.
+func UidExpunge(c *client.Client, seq *imap.SeqSet) error {
+	if ok, _ := c.Support("UIDPLUS"); !ok {
+		return ErrNoUidplus
+	}
+	cmd := &imap.Command{Name: "UID", Arguments: []interface{}{imap.RawString("EXPUNGE"), seq}}
+	if status, e := c.Execute(cmd, nil); e != nil {
+		return e
+	} else {
+		return status.Err()
+	}
+}
+
+// copyUid records the COPYUID response code (RFC 4315) of COPY and MOVE.
+type copyUid struct {
+	uidvalidity uint32
+	uids        map[uint32]uint32 // source uid -> destination uid
+}
+
+func (r *copyUid) Parse(status *imap.StatusResp) error {
+	if status.Code != "COPYUID" || len(status.Arguments) < 3 {
+		return responses.ErrUnhandled
+	}
+	var src, dst []uint32
+	for k, list := range []*[]uint32{&src, &dst} {
+		if str, e := imap.ParseString(status.Arguments[k+1]); e != nil {
+			return e
+		} else if seq, e := imap.ParseSeqSet(str); e != nil {
+			return e
+		} else {
+			for _, s := range seq.Set {
+				for uid := s.Start; uid <= s.Stop; uid++ {
+					*list = append(*list, uid)
+				}
+			}
+		}
+	}
+	if len(src) != len(dst) {
+		return fmt.Errorf("invalid COPYUID")
+	}
+	r.uidvalidity, _ = imap.ParseNumber(status.Arguments[0])
+	for k := range src {
+		r.uids[src[k]] = dst[k]
+	}
+	return nil
+}
+
+// UidMove moves the messages in seq to dest, with MOVE if the server supports
+// it and COPY, STORE and EXPUNGE otherwise, which needs UIDPLUS. It returns
+// the uids of the moved messages in dest, which are only known if the server
+// supports UIDPLUS.
+func UidMove(c *client.Client, seq *imap.SeqSet, dest string) (*copyUid, error) {
+	res := &copyUid{uids: make(map[uint32]uint32)}
+	handler := responses.HandlerFunc(func(resp imap.Resp) error {
+		if status, ok := resp.(*imap.StatusResp); ok {
+			return res.Parse(status)
+		}
+		return responses.ErrUnhandled
+	})
+	if ok, e := c.Support("MOVE"); e != nil {
+		return nil, e
+	} else if ok {
+		// COPYUID comes in an untagged OK
+		cmd := &commands.Uid{Cmd: &commands.Move{SeqSet: seq, Mailbox: dest}}
+		if status, e := c.Execute(cmd, handler); e != nil {
+			return nil, e
+		} else {
+			return res, status.Err()
+		}
+	}
+	if ok, _ := c.Support("UIDPLUS"); !ok {
+		return nil, ErrNoUidplus
+	}
+	cmd := &commands.Uid{Cmd: &commands.Copy{SeqSet: seq, Mailbox: dest}}
+	if status, e := c.Execute(cmd, nil); e != nil {
+		return nil, e
+	} else if e := status.Err(); e != nil {
+		return nil, e
+	} else {
+		res.Parse(status)
+	}
+	if e := c.UidStore(seq, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); e != nil {
+		return nil, e
+	}
+	return res, UidExpunge(c, seq)
+}
+
+// SpecialUse returns the mailbox with the special-use attribute attr.
+func SpecialUse(c *client.Client, attr string) (string, error) {
+	mailboxes := make(chan *imap.MailboxInfo, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.List("", "*", mailboxes)
+	}()
+	var name string
+	for m := range mailboxes {
+		for _, a := range m.Attributes {
+			if a == attr && name == "" {
+				name = m.Name
+			}
+		}
+	}
+	if e := <-done; e != nil {
+		return "", e
+	} else if name == "" {
+		return "", fmt.Errorf("no %s mailbox", attr)
+	}
+	return name, nil
+}
+
+// Archive moves read messages older than the archive period of the mailbox,
+// whose full message is in the store, to the \Archive folder of the account.
+// Their records move to the index of the \Archive folder if it is among ids,
+// so that neither side sees a deletion or an arrival.
+func (id *IndexData) Archive(ids []*IndexData) error {
+	c := <-id.cc
+	defer func() {
+		id.cc <- c
+	}()
+	dest, e := SpecialUse(c, imap.ArchiveAttr)
+	if e != nil {
+		return e
+	} else if dest == id.mailboxname {
+		return nil
+	}
+	if _, e := c.Select(id.mailboxname, false); e != nil {
+		return e
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Before = time.Now().AddDate(0, 0, -id.options.archive)
+	criteria.WithFlags = []string{imap.SeenFlag}
+	uids, e := c.UidSearch(criteria)
+	if e != nil || len(uids) == 0 {
+		return e
+	}
+
+	indextickets := id.GenerateIndexTickets()
+	moved := new(imap.SeqSet)
+	for _, uid := range uids {
+		if it := indextickets.Lookup(uid); it == nil {
+			continue
+		} else if b := id.indexbytes[it.location]; Archived(*targetdir, b[4:digest_length+4], b[variant_offset]) {
+			moved.AddNum(uid)
+		}
+	}
+	if moved.Empty() {
+		return nil
+	}
+	res, e := UidMove(c, moved, dest)
+	if e == ErrNoUidplus {
+		EmitError(id.account, id.mailboxname, fmt.Errorf("archive: %w", e))
+		return nil
+	} else if e != nil {
+		return e
+	}
+
+	var target *IndexData
+	for _, other := range ids {
+		if other.cc == id.cc && other.mailboxname == dest {
+			target = other
+		}
+	}
+	var count int
+	indexbytes := id.indexbytes[:0]
+	for _, b := range id.indexbytes {
+		uid := read_uint32(b[:4])
+		if !moved.Contains(uid) {
+			indexbytes = append(indexbytes, b)
+			continue
+		}
+		count++
+		if target == nil {
+			continue
+		} else if new_uid, ok := res.uids[uid]; ok && target.uidvalidity == res.uidvalidity {
+			put_uint32(b[:4], new_uid)
+			target.indexbytes = append(target.indexbytes, b)
+		}
+		// otherwise the next run of the target finds it by its headers
+	}
+	id.indexbytes = indexbytes
+	if target != nil {
+		target.Sort(5)
+	}
+	Emit(Event{Event: "archived", Account: id.account, Mailbox: id.mailboxname, Count: count}, "a %s: %d moved to %s\n", filepath.Base(id.filename)[:5], count, dest)
+	return nil
+}
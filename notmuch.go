@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/sha1"
 	"fmt"
 	"io"
 	"net/mail"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 )
 
@@ -17,7 +19,7 @@ func UpdateNotmuch(path_buffer *bytes.Buffer) error {
 	}
 	update := exec.Command("notmuch", "new")
 	if e := update.Run(); e != nil {
-		panic(e)
+		return fmt.Errorf("notmuch new: %w", e)
 	}
 
 	cmd := exec.Command("notmuch", "tag", "--batch")
@@ -29,28 +31,43 @@ func UpdateNotmuch(path_buffer *bytes.Buffer) error {
 			if line, e := path_buffer.ReadString('\n'); e == io.EOF {
 				break
 			} else if e != nil {
-				panic(e)
+				wp.CloseWithError(e)
+				return
 			} else {
 				arr := strings.Split(line, " ")
 				tags := arr[:len(arr)-1]
 				path := arr[len(arr)-1]
 				tags_joined := strings.Join(tags, " ")
 				var red io.ReadCloser
+				// notmuch names messages without a Message-ID after the
+				// sha1 of the file as stored
+				hasher := sha1.New()
 				if f, e := os.Open(strings.TrimSpace(path)); e == nil {
 					red = f
 				} else if g, e := os.Open(strings.TrimSpace(path) + ".gz"); e != nil {
 					g.Close()
 					f.Close()
 					continue
-				} else if r, e := gzip.NewReader(g); e != nil {
-					panic(e)
+				} else if r, e := gzip.NewReader(io.TeeReader(g, hasher)); e != nil {
+					// left for verify to report
+					g.Close()
+					continue
 				} else {
 					red = r
 				}
-				if msg, err := mail.ReadMessage(red); err == nil {
-					fmt.Fprintf(wp, "%s id:%s\n", tags_joined, strings.Trim(msg.Header.Get("Message-ID"), "<>"))
+				if b, e := io.ReadAll(red); e != nil {
+					red.Close()
+					continue
+				} else if msg, err := mail.ReadMessage(bytes.NewReader(b)); err != nil {
+					red.Close()
+					continue
+				} else if msgid := msg.Header.Get("Message-ID"); msgid != "" {
+					fmt.Fprintf(wp, "%s id:%s\n", tags_joined, strings.Trim(msgid, "<>"))
 				} else {
-					panic(err)
+					if _, ok := red.(*os.File); ok {
+						hasher.Write(b)
+					}
+					fmt.Fprintf(wp, "%s id:notmuch-sha1-%x\n", tags_joined, hasher.Sum(nil))
 				}
 				red.Close()
 			}
@@ -59,3 +76,94 @@ func UpdateNotmuch(path_buffer *bytes.Buffer) error {
 	}()
 	return cmd.Run()
 }
+
+// ApplyPendingTags hands the tag lines saved by an earlier run for ids to
+// notmuch, see SavePendingTags.
+func ApplyPendingTags(ids []*IndexData) error {
+	path_buffer := bytes.NewBuffer(nil)
+	for _, id := range ids {
+		if e := id.ReadPendingTags(path_buffer); e != nil {
+			return e
+		}
+	}
+	if e := UpdateNotmuch(path_buffer); e != nil {
+		return e
+	}
+	for _, id := range ids {
+		if e := id.RemovePendingTags(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// LocalFlags reads the notmuch tags of the messages in targetdir and
+// converts them into flag bytes, keyed by their store path relative to
+// targetdir, see RecordPath. Messages are found by their files, so this works
+// whatever headers their digest is over. The offline bit is never set, since
+// it has no IMAP counterpart to push.
+func LocalFlags(targetdir string) (map[string]byte, error) {
+	root, e := filepath.Abs(targetdir)
+	if e != nil {
+		return nil, e
+	} else if real, e := filepath.EvalSymlinks(root); e == nil {
+		// notmuch reports paths below its real database path
+		root = real
+	}
+	local := make(map[string]byte)
+	// without tags, a message is read and has no flags
+	if files, e := NotmuchFiles("*"); e != nil {
+		return nil, e
+	} else {
+		for _, f := range files {
+			if rel, ok := StoreRel(root, f); ok {
+				local[rel] = 0x01
+			}
+		}
+	}
+	for k, tag := range taglist {
+		if k == 2 {
+			continue
+		}
+		files, e := NotmuchFiles("tag:" + tag)
+		if e != nil {
+			return nil, e
+		}
+		for _, f := range files {
+			rel, ok := StoreRel(root, f)
+			if _, known := local[rel]; !ok || !known {
+				continue
+			} else if k == 0 {
+				local[rel] &^= 0x01
+			} else {
+				local[rel] |= 0x01 << k
+			}
+		}
+	}
+	return local, nil
+}
+
+// NotmuchFiles returns the files of the messages matching query.
+func NotmuchFiles(query string) ([]string, error) {
+	out, e := exec.Command("notmuch", "search", "--output=files", "--format=text0", query).Output()
+	if e != nil {
+		return nil, fmt.Errorf("notmuch search %s: %w", query, e)
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// StoreRel returns the path of file relative to the store root, without the
+// .gz suffix, if it is in the store.
+func StoreRel(root string, file string) (string, bool) {
+	rel, e := filepath.Rel(root, strings.TrimSuffix(file, ".gz"))
+	if e != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return rel, true
+}
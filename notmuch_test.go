@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestStoreRel(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		rel  string
+		ok   bool
+	}{
+		{"/mail/target/ab/cdef", "ab/cdef", true},
+		{"/mail/target/ab/cdef.1", "ab/cdef.1", true},
+		{"/mail/target/ab/cdef.gz", "ab/cdef", true},
+		{"/mail/target/ab/cdef.2.gz", "ab/cdef.2", true},
+		{"/mail/other/ab/cdef", "", false},
+		{"/mail/targetx/ab/cdef", "", false},
+	} {
+		if rel, ok := StoreRel("/mail/target", tc.file); rel != tc.rel || ok != tc.ok {
+			t.Errorf("StoreRel(%q) = %q, %v", tc.file, rel, ok)
+		}
+	}
+	// the index looks messages up the same way
+	var b [index_record_size]byte
+	b[4], b[5], b[variant_offset] = 0xab, 0xcd, 1
+	if rel, _ := StoreRel("/t", RecordPath("/t", b[:])+".gz"); rel != RecordPath("", b[:]) {
+		t.Errorf("record path %q, store path %q", RecordPath("", b[:]), rel)
+	}
+}
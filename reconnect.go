@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// after a dropped connection, reconnect_attempts are made, the first after
+// reconnect_backoff and each following one after twice as long
+const reconnect_attempts = 5
+const reconnect_backoff = time.Second
+
+// Reconnect replaces the closed clients of the account of id, and reports
+// whether there were any. Clients in use by other mailboxes are waited for.
+func (id *IndexData) Reconnect() (dropped bool, err error) {
+	// clients are put back at the end, so each is seen once
+	for k := 0; k < cap(id.cc); k++ {
+		c := <-id.cc
+		select {
+		case <-c.LoggedOut():
+		default:
+			id.cc <- c
+			continue
+		}
+		dropped = true
+		wait := reconnect_backoff
+		for attempt := 1; attempt <= reconnect_attempts; attempt++ {
+			time.Sleep(wait)
+			wait *= 2
+			if n, e := id.dial(); e != nil {
+				err = fmt.Errorf("reconnect: %w", e)
+			} else {
+				c, err = n, nil
+				Emit(Event{Event: "reconnected", Account: id.account, Mailbox: id.mailboxname, Count: attempt}, "reconnect %s: %d attempts\n", filepath.Base(id.filename)[:5], attempt)
+				break
+			}
+		}
+		id.cc <- c
+		if err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
+// ClosedError reports whether e comes from a connection which was closed,
+// and which another mailbox of the account may have replaced already.
+func ClosedError(e error) bool {
+	var ne net.Error
+	return errors.Is(e, client.ErrNotLoggedIn) || errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF) ||
+		errors.Is(e, net.ErrClosed) || errors.As(e, &ne) || strings.HasSuffix(e.Error(), "connection closed")
+}
+
+// Retry runs op, and runs it again on new connections whenever a connection
+// drops while it runs.
+func (id *IndexData) Retry(op func() error) error {
+	for k := 0; ; k++ {
+		if e := op(); e == nil || k == reconnect_attempts {
+			return e
+		} else if dropped, err := id.Reconnect(); err != nil {
+			return err
+		} else if !dropped && !ClosedError(e) {
+			return e
+		}
+	}
+}
+
+// Update is ForceUpdate, starting over from the index as it was if the
+// connection drops. Operations on the server are safe to repeat. If it
+// fails, the index is left as it was, so that a later sync of the daemon
+// finds the same changes again.
+func (id *IndexData) Update(path_buffer *bytes.Buffer) error {
+	indexbytes := append([][index_record_size]byte(nil), id.indexbytes...)
+	uidvalidity, modseq := id.uidvalidity, id.modseq
+	restore := func() {
+		id.indexbytes = append(id.indexbytes[:0], indexbytes...)
+		id.uidvalidity, id.modseq, id.stale = uidvalidity, modseq, nil
+	}
+	e := id.Retry(func() error {
+		restore()
+		path_buffer.Reset()
+		if e := id.ReadPendingTags(path_buffer); e != nil {
+			return e
+		}
+		return id.ForceUpdate(path_buffer)
+	})
+	if e != nil {
+		restore()
+	}
+	return e
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Rehash recomputes the digests of the mailboxes configured on stdin whose
+// index was written with other canonical headers than their account now
+// uses. Store entries are linked to their new digest, and the old entries
+// are removed once no index refers to them anymore.
+func Rehash() error {
+	todo := make(map[string]Canonical)
+	accounts, e := ReadAccounts(os.Stdin)
+	if e != nil {
+		return e
+	}
+	for _, ac := range accounts {
+		conf, e := OpenAccount(ac)
+		if e != nil {
+			return e
+		} else if e := conf.Load(); e != nil {
+			return e
+		} else if len(conf.include) > 0 {
+			// the discovered folders need rehashing as well
+			if c, e := conf.Dial(); e != nil {
+				return e
+			} else if e := conf.Discover(c); e != nil {
+				c.Logout()
+				return e
+			} else {
+				c.Logout()
+			}
+		}
+		for _, mailbox := range conf.folders {
+			id := &IndexData{filename: filepath.Join(*indexdir, GenerateMailboxID(mailbox, conf.addr, conf.salt))}
+			if e := id.ReadIndexFile(); os.IsNotExist(e) {
+				continue
+			} else if e != nil {
+				return e
+			} else if id.canonical.String() != conf.canonical.String() {
+				todo[id.filename] = conf.canonical
+			}
+		}
+	}
+
+	// store paths which must stay where they are
+	keep := make(map[string]bool)
+	entries, e := os.ReadDir(*indexdir)
+	if e != nil {
+		return e
+	}
+	for _, entry := range entries {
+		filename := filepath.Join(*indexdir, entry.Name())
+		if _, ok := todo[filename]; ok || entry.IsDir() || !IsIndexName(entry.Name()) {
+			continue
+		}
+		id := &IndexData{filename: filename}
+		if e := id.ReadIndexFile(); e != nil {
+			return e
+		}
+		for _, b := range id.indexbytes {
+			keep[RecordPath(*targetdir, b[:])] = true
+		}
+	}
+
+	old := make(map[string]bool)
+	wb := new(bufio.Writer)
+	for filename, canonical := range todo {
+		id := &IndexData{filename: filename}
+		if e := id.ReadIndexFile(); e != nil {
+			return e
+		} else if e := id.Rehash(canonical, old, keep); e != nil {
+			return e
+		} else if e := id.SaveIndexFile(wb); e != nil {
+			return e
+		}
+	}
+	for path := range old {
+		if keep[path] {
+			continue
+		}
+		for _, p := range []string{path, path + ".gz"} {
+			if e := os.Remove(p); e != nil && !os.IsNotExist(e) {
+				return e
+			}
+		}
+	}
+	if len(todo) > 0 && !*no_notmuch {
+		// the files keep their content, so notmuch picks up the renames by
+		// Message-ID, or for messages without one by the sha1 of the file
+		return exec.Command("notmuch", "new").Run()
+	}
+	return nil
+}
+
+// Rehash recomputes the digests of id over canonical, linking each store
+// entry to its new digest. Old store paths are added to old, new ones to
+// keep.
+// Messages which are not fully archived are dropped from the index, so that
+// the next run fetches their headers again.
+func (id *IndexData) Rehash(canonical Canonical, old, keep map[string]bool) error {
+	hasher := sha256.New()
+	var moved, dropped int
+	indexbytes := id.indexbytes[:0]
+	for _, b := range id.indexbytes {
+		var digest [digest_length]byte
+		copy(digest[:], b[4:digest_length+4])
+		src := RecordPath(*targetdir, b[:])
+		body, e := ReadStoreFile(src)
+		if errors.Is(e, ErrStub) || os.IsNotExist(e) {
+			dropped++
+			continue
+		} else if e != nil {
+			return e
+		}
+		m, e := mail.ReadMessage(bytes.NewReader(body))
+		if e != nil {
+			return e
+		} else if _, e := canonical.WriteIdentity(m.Header, m.Body, hasher); e != nil {
+			return e
+		}
+		var new_digest [digest_length]byte
+		copy(new_digest[:], hasher.Sum(nil))
+		hasher.Reset()
+		if new_digest != digest {
+			old[src] = true
+			variant, e := LinkVariant(src, new_digest[:], uint32(len(body)))
+			if e != nil {
+				return e
+			}
+			copy(b[4:digest_length+4], new_digest[:])
+			b[variant_offset] = variant
+			moved++
+		}
+		keep[RecordPath(*targetdir, b[:])] = true
+		indexbytes = append(indexbytes, b)
+	}
+	id.indexbytes = indexbytes
+	id.canonical = canonical
+	if e := id.Sort(5); e != nil {
+		return e
+	}
+	fmt.Fprintf(os.Stderr, "d %s: %d moved, %d dropped\n", filepath.Base(id.filename)[:5], moved, dropped)
+	return nil
+}
+
+// LinkVariant links the message at the store path src to the first variant
+// of digest which is free or holds a message of the same size.
+func LinkVariant(src string, digest []byte, size uint32) (byte, error) {
+	gz := ""
+	if _, e := os.Stat(src); e != nil {
+		gz = ".gz"
+	}
+	for variant := byte(0); variant < 0xff; variant++ {
+		dst := StorePath(*targetdir, digest, variant)
+		if n, stub, e := StoreSize(dst); os.IsNotExist(e) {
+			if e := os.MkdirAll(filepath.Dir(dst), os.ModePerm); e != nil {
+				return 0, e
+			}
+			return variant, os.Link(src+gz, dst+gz)
+		} else if e != nil {
+			return 0, e
+		} else if !stub && n == size {
+			return variant, nil
+		}
+	}
+	return 0, fmt.Errorf("%02x: too many variants", digest)
+}
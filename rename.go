@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// records compared against the server before taking over an index
+const rename_samples = 8
+
+// FindRenamed looks for the index of a folder which was renamed on the server
+// to the mailbox of id, which is selected on c and has no index yet. An index
+// matches if it has the same MAILBOXID or, on servers without one, the same
+// UIDVALIDITY and the digests of sampled uids. Indexes of the account's
+// current folders are skipped. A match is moved to id.filename, except with -dry-run, and its
+// records are taken over.
+func (id *IndexData) FindRenamed(c *client.Client, stat *imap.MailboxStatus, folders []string, salt []byte) error {
+	in_use := make(map[string]bool, len(folders))
+	for _, f := range folders {
+		in_use[GenerateMailboxID(f, id.addr, salt)] = true
+	}
+	entries, e := os.ReadDir(*indexdir)
+	if e != nil {
+		return e
+	}
+	for _, entry := range entries {
+		// index files are named by eight characters
+		if name := entry.Name(); !IsIndexName(name) || entry.IsDir() || in_use[name] {
+			continue
+		}
+		other := &IndexData{filename: filepath.Join(*indexdir, entry.Name())}
+		if e := other.ReadIndexFile(); e != nil {
+			// not an index, or a broken one which verify reports
+			continue
+		} else if other.addr != "" && other.addr != id.addr {
+			continue
+		} else if other.canonical.String() != id.canonical.String() {
+			continue
+		} else if id.objectid != "" && other.objectid != "" {
+			if id.objectid != other.objectid {
+				continue
+			}
+		} else if other.uidvalidity != stat.UidValidity || len(other.indexbytes) == 0 {
+			continue
+		} else if ok, e := id.SampleMatches(c, other); e != nil {
+			return e
+		} else if !ok {
+			continue
+		}
+		if !*dry_run {
+			if e := os.Rename(other.filename, id.filename); e != nil {
+				return e
+			} else if e := os.Rename(other.filename+tags_suffix, id.filename+tags_suffix); e != nil && !os.IsNotExist(e) {
+				return e
+			}
+		}
+		Emit(Event{Event: "renamed", Account: id.account, Mailbox: id.mailboxname, Count: len(other.indexbytes)}, "r %s: renamed from %s (%s)\n", filepath.Base(id.filename)[:5], other.mailboxname, entry.Name()[:5])
+		id.uidvalidity = other.uidvalidity
+		id.modseq = other.modseq
+		id.indexbytes = other.indexbytes
+		if id.objectid == "" {
+			id.objectid = other.objectid
+		}
+		return nil
+	}
+	return nil
+}
+
+// SampleMatches fetches the canonical headers of up to rename_samples
+// records of other from the selected mailbox, and reports whether their
+// digests agree. Records whose uid is gone or which need fallback headers
+// are not compared; at least one must be.
+func (id *IndexData) SampleMatches(c *client.Client, other *IndexData) (bool, error) {
+	digests := make(map[uint32][]byte, rename_samples)
+	seq := new(imap.SeqSet)
+	step := len(other.indexbytes)/rename_samples + 1
+	for k := 0; k < len(other.indexbytes); k += step {
+		b := other.indexbytes[k]
+		uid := read_uint32(b[:4])
+		digests[uid] = b[4 : digest_length+4]
+		seq.AddNum(uid)
+	}
+	fetch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seq, id.canonical.FetchItems(), fetch)
+	}()
+	hasher := sha256.New()
+	section := id.canonical.Section()
+	compared, matched := 0, true
+	for msg := range fetch {
+		if r := msg.GetBody(section); r == nil {
+			continue
+		} else if m, e := mail.ReadMessage(r); e != nil || !id.canonical.Has(m.Header) {
+			continue
+		} else if _, e := id.canonical.WriteIdentity(m.Header, nil, hasher); e != nil {
+			matched = false
+		} else if digest, ok := digests[msg.Uid]; ok {
+			compared++
+			matched = matched && bytes.Equal(hasher.Sum(nil)[:digest_length], digest)
+		}
+		hasher.Reset()
+	}
+	if e := <-done; e != nil {
+		return false, fmt.Errorf("rename: %w", e)
+	}
+	return matched && compared > 0, nil
+}
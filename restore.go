@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// a message as told apart by Restore: variants share the digest, but not
+// the size
+type message_key struct {
+	digest [digest_length]byte
+	size   uint32
+}
+
+// RemoteDigests returns the digests and sizes of the messages in the
+// selected mailbox.
+func RemoteDigests(c *client.Client, canonical Canonical) (map[message_key]bool, error) {
+	digests := make(map[message_key]bool)
+	if c.Mailbox().Messages == 0 {
+		return digests, nil
+	}
+	seq := new(imap.SeqSet)
+	seq.AddRange(1, c.Mailbox().Messages)
+	fetch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Fetch(seq, canonical.FetchItems(), fetch)
+	}()
+	hasher := sha256.New()
+	anonymous := new(imap.SeqSet)
+	section := canonical.Section()
+	for msg := range fetch {
+		if r := msg.GetBody(section); r == nil {
+			// an unsolicited FETCH, e.g. of flags
+			continue
+		} else if m, e := mail.ReadMessage(r); e != nil || !canonical.Has(m.Header) {
+			anonymous.AddNum(msg.SeqNum)
+			continue
+		} else if _, e := canonical.WriteHeaders(m.Header, hasher); e != nil {
+			return nil, e
+		}
+		var key message_key
+		copy(key.digest[:], hasher.Sum(nil))
+		key.size = msg.Size
+		hasher.Reset()
+		digests[key] = true
+	}
+	if e := <-done; e != nil || anonymous.Empty() {
+		return digests, e
+	}
+
+	fallback := make(chan *imap.Message)
+	go func() {
+		done <- c.Fetch(anonymous, fallback_fetch_items, fallback)
+	}()
+	for msg := range fallback {
+		if r := msg.GetBody(fallback_header_section); r == nil {
+			continue
+		} else if m, e := mail.ReadMessage(r); e != nil {
+			continue
+		} else if _, e := WriteFallback(m.Header, msg.GetBody(text_section), hasher); e != nil {
+			return nil, e
+		}
+		var key message_key
+		copy(key.digest[:], hasher.Sum(nil))
+		key.size = msg.Size
+		hasher.Reset()
+		digests[key] = true
+	}
+	return digests, <-done
+}
+
+// Restore uploads the archived messages of the index file to mailbox on the
+// account of conf, with their original flags and INTERNALDATE. Messages
+// whose digest already exists in mailbox are skipped, and where the index
+// has several variants of a digest, those whose size exists as well.
+func Restore(index string, conf *Config, mailbox string) error {
+	id := &IndexData{filename: index}
+	if e := id.ReadIndexFile(); e != nil {
+		return e
+	}
+	id.UidSort()
+
+	cc, e := conf.InitClient()
+	if e != nil {
+		return e
+	}
+	c := <-cc
+	defer c.Logout()
+	if _, e := c.Select(mailbox, false); e != nil {
+		// the folder may not exist yet
+		if e := c.Create(mailbox); e != nil {
+			return e
+		} else if _, e := c.Select(mailbox, false); e != nil {
+			return e
+		}
+	}
+	// digests of the target are comparable to the ones in the index
+	existing, e := RemoteDigests(c, id.canonical)
+	if e != nil {
+		return e
+	}
+
+	// a digest with a single variant is skipped by the digest alone, since the
+	// server may have rewritten the message when it was appended
+	variants := make(map[[digest_length]byte]map[byte]bool)
+	remote := make(map[[digest_length]byte]bool, len(existing))
+	for _, b := range id.indexbytes {
+		digest := [digest_length]byte(b[4 : digest_length+4])
+		if variants[digest] == nil {
+			variants[digest] = make(map[byte]bool)
+		}
+		variants[digest][b[variant_offset]] = true
+	}
+	for key := range existing {
+		remote[key.digest] = true
+	}
+
+	var count, present, missing int
+	for _, b := range id.indexbytes {
+		var key message_key
+		copy(key.digest[:], b[4:digest_length+4])
+		size, stub, e := StoreSize(StorePath(*targetdir, key.digest[:], b[variant_offset]))
+		if os.IsNotExist(e) {
+			missing++
+			continue
+		} else if e != nil {
+			return e
+		} else if key.size = size; existing[key] || len(variants[key.digest]) == 1 && remote[key.digest] {
+			present++
+			continue
+		} else if stub {
+			missing++
+			continue
+		}
+		body, e := ReadMessage(*targetdir, key.digest[:], b[variant_offset])
+		if errors.Is(e, ErrStub) || os.IsNotExist(e) {
+			missing++
+			continue
+		} else if e != nil {
+			return e
+		}
+		flags := make([]string, 0, len(flaglist))
+		for k, fl := range flaglist {
+			// \Deleted would get the restored message expunged again
+			if k != 2 && b[digest_length+4]&(0x01<<k) != 0 {
+				flags = append(flags, fl)
+			}
+		}
+		var date time.Time
+		if d := read_uint32(b[digest_length+5 : digest_length+9]); d != 0 {
+			date = time.Unix(int64(d), 0)
+		}
+		if e := c.Append(mailbox, flags, date, bytes.NewBuffer(body)); e != nil {
+			return e
+		}
+		existing[key], remote[key.digest] = true, true
+		count++
+	}
+	fmt.Fprintf(os.Stderr, "r %s: %d appended, %d present, %d not archived\n", filepath.Base(index), count, present, missing)
+	return nil
+}
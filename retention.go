@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// Expire deletes messages older than the retention period of the mailbox
+// from the server, but only those whose full message is in the store. The
+// local copies are tagged +offline.
+func (id *IndexData) Expire(path_buffer *bytes.Buffer) error {
+	c := <-id.cc
+	defer func() {
+		id.cc <- c
+	}()
+	if _, e := c.Select(id.mailboxname, false); e != nil {
+		return e
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.Before = time.Now().AddDate(0, 0, -id.options.retain)
+	uids, e := c.UidSearch(criteria)
+	if e != nil || len(uids) == 0 {
+		return e
+	}
+
+	indextickets := id.GenerateIndexTickets()
+	expired := new(imap.SeqSet)
+	var kept int
+	for _, uid := range uids {
+		it := indextickets.Lookup(uid)
+		if it == nil {
+			kept++
+			continue
+		}
+		b := id.indexbytes[it.location]
+		if !Archived(*targetdir, b[4:digest_length+4], b[variant_offset]) {
+			kept++
+			continue
+		}
+		expired.AddNum(uid)
+	}
+	if expired.Empty() {
+		return nil
+	} else if ok, _ := c.Support("UIDPLUS"); !ok {
+		EmitError(id.account, id.mailboxname, fmt.Errorf("retain: %w", ErrNoUidplus))
+		return nil
+	}
+
+	if e := c.UidStore(expired, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); e != nil {
+		return e
+	}
+	if e := UidExpunge(c, expired); e != nil {
+		return e
+	}
+
+	var count int
+	indexbytes := id.indexbytes[:0]
+	for _, b := range id.indexbytes {
+		if expired.Contains(read_uint32(b[:4])) {
+			fmt.Fprintf(path_buffer, "+offline %s\n", RecordPath(*targetdir, b[:]))
+			count++
+		} else {
+			indexbytes = append(indexbytes, b)
+		}
+	}
+	id.indexbytes = indexbytes
+	Emit(Event{Event: "expunged", Account: id.account, Mailbox: id.mailboxname, Count: count}, "x %s: %d expunged, %d not archived\n", filepath.Base(id.filename)[:5], count, kept)
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// IsStub reports whether b is a header stub written by ResponseTicket.Stat,
+// which stands in for a message until it is fully fetched.
+func IsStub(b []byte) bool {
+	return bytes.Index(b, []byte("\n\n")) == len(b)-2
+}
+
+var ErrStub = fmt.Errorf("message not fully archived")
+
+// VariantSuffix distinguishes messages which share a digest, see
+// ResponseTicket.Stat; the first one has none.
+func VariantSuffix(variant byte) string {
+	if variant == 0 {
+		return ""
+	}
+	return fmt.Sprintf(".%d", variant)
+}
+
+// StorePath returns the path of the message with digest in targetdir,
+// without the .gz suffix of compressed messages.
+func StorePath(targetdir string, digest []byte, variant byte) string {
+	return filepath.Join(targetdir, fmt.Sprintf("%02x", digest[0]), fmt.Sprintf("%02x", digest[1:])+VariantSuffix(variant))
+}
+
+// RecordPath returns the store path of an index record.
+func RecordPath(targetdir string, b []byte) string {
+	return StorePath(targetdir, b[4:digest_length+4], b[variant_offset])
+}
+
+// ReadMessage returns the full message with digest, decompressing it if it
+// is stored as .gz, or ErrStub if only its header stub exists.
+func ReadMessage(targetdir string, digest []byte, variant byte) ([]byte, error) {
+	return ReadStoreFile(StorePath(targetdir, digest, variant))
+}
+
+// ReadStoreFile is ReadMessage for the store path of a message.
+func ReadStoreFile(path string) ([]byte, error) {
+	path = strings.TrimSuffix(path, ".gz")
+	if b, e := os.ReadFile(path); e == nil {
+		if IsStub(b) {
+			return nil, ErrStub
+		}
+		return b, nil
+	} else if !os.IsNotExist(e) {
+		return nil, e
+	}
+	if f, e := os.Open(path + ".gz"); e != nil {
+		return nil, e
+	} else {
+		defer f.Close()
+		if r, e := gzip.NewReader(f); e != nil {
+			return nil, e
+		} else {
+			return io.ReadAll(r)
+		}
+	}
+}
+
+// StoreSize returns the size of the message at path, before compression if
+// it is stored as .gz, and whether it is a header stub, in which case size
+// is the one expected by ResponseTicket.Stat, or zero if unknown.
+func StoreSize(path string) (size uint32, stub bool, e error) {
+	if i, e := os.Stat(path); e == nil {
+		if i.Size() > 4096 {
+			// far larger than any header stub
+			return uint32(i.Size()), false, nil
+		} else if b, e := os.ReadFile(path); e != nil {
+			return 0, false, e
+		} else if !IsStub(b) {
+			return uint32(len(b)), false, nil
+		} else if m, e := mail.ReadMessage(bytes.NewReader(b)); e != nil {
+			return 0, true, nil
+		} else {
+			n, _ := strconv.ParseUint(m.Header.Get(stub_size_header), 10, 32)
+			return uint32(n), true, nil
+		}
+	} else if !os.IsNotExist(e) {
+		return 0, false, e
+	}
+	f, e := os.Open(path + ".gz")
+	if e != nil {
+		return 0, false, e
+	}
+	defer f.Close()
+	// the gzip trailer ends with the input size modulo 2^32
+	var isize [4]byte
+	if i, e := f.Stat(); e != nil {
+		return 0, false, e
+	} else if _, e := f.ReadAt(isize[:], i.Size()-4); e != nil {
+		return 0, false, e
+	}
+	return read_uint32(isize[:]), false, nil
+}
+
+// Archived reports whether the full message with digest is in targetdir.
+func Archived(targetdir string, digest []byte, variant byte) bool {
+	_, stub, e := StoreSize(StorePath(targetdir, digest, variant))
+	return e == nil && !stub
+}
+
+// Recompress gzips every full message in targetdir. Each message is written
+// to <digest>.gz before the uncompressed file is removed, so that one of the
+// two always exists. Messages without a Message-ID are left as they are:
+// notmuch knows them by the sha1 of the file, which gzip would change, and
+// their tags would be lost.
+func Recompress(targetdir string) error {
+	var count, skipped, before, after int64
+	e := filepath.WalkDir(targetdir, func(path string, d os.DirEntry, e error) error {
+		if e != nil {
+			return e
+		} else if d.IsDir() || strings.HasSuffix(path, ".gz") || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		b, e := os.ReadFile(path)
+		if e != nil {
+			return e
+		} else if IsStub(b) {
+			return nil
+		} else if m, e := mail.ReadMessage(bytes.NewReader(b)); e != nil || m.Header.Get("Message-ID") == "" {
+			skipped++
+			return nil
+		}
+		g, e := os.CreateTemp(targetdir, ".tmp_message")
+		if e != nil {
+			return e
+		}
+		zw := gzip.NewWriter(g)
+		if _, e := zw.Write(b); e != nil {
+			g.Close()
+			return e
+		} else if e := zw.Close(); e != nil {
+			g.Close()
+			return e
+		} else if e := g.Sync(); e != nil {
+			g.Close()
+			return e
+		} else if i, e := g.Stat(); e != nil {
+			g.Close()
+			return e
+		} else if e := g.Close(); e != nil {
+			return e
+		} else if e := os.Rename(g.Name(), path+".gz"); e != nil {
+			return e
+		} else if e := os.Remove(path); e != nil {
+			return e
+		} else {
+			count++
+			before += int64(len(b))
+			after += i.Size()
+		}
+		return nil
+	})
+	if e != nil {
+		return e
+	}
+	fmt.Fprintf(os.Stderr, "z: %d messages, %0.4f MB -> %0.4f MB, %d without Message-ID left\n", count, float64(before)/1000000, float64(after)/1000000, skipped)
+	if count > 0 && !*no_notmuch {
+		// notmuch picks up the renames by Message-ID
+		return exec.Command("notmuch", "new").Run()
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsStub(t *testing.T) {
+	for _, tc := range []struct {
+		b    string
+		stub bool
+	}{
+		{"Message-ID: <a@example.com>\nX-Archive-Size: 100\n\n", true},
+		{"Message-ID: <a@example.com>\n\nbody\n", false},
+		{"Message-ID: <a@example.com>\n\n\n", false},
+		{"", false},
+	} {
+		if IsStub([]byte(tc.b)) != tc.stub {
+			t.Errorf("%q: stub %v", tc.b, !tc.stub)
+		}
+	}
+}
+
+func TestStoreSize(t *testing.T) {
+	dir := t.TempDir()
+	message := []byte("Message-ID: <a@example.com>\n\nbody\n")
+	large := bytes.Repeat([]byte("x"), 5000)
+
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if e := os.WriteFile(path, b, 0644); e != nil {
+			t.Fatal(e)
+		}
+		return path
+	}
+	gz := func(name string, b []byte) string {
+		buf := new(bytes.Buffer)
+		zw := gzip.NewWriter(buf)
+		zw.Write(b)
+		zw.Close()
+		write(name+".gz", buf.Bytes())
+		return filepath.Join(dir, name)
+	}
+	for _, tc := range []struct {
+		name string
+		path string
+		size uint32
+		stub bool
+	}{
+		{"message", write("message", message), uint32(len(message)), false},
+		{"large", write("large", large), uint32(len(large)), false},
+		{"stub", write("stub", []byte("Message-ID: <a@example.com>\nX-Archive-Size: 1234\n\n")), 1234, true},
+		{"stub without size", write("old_stub", []byte("Message-ID: <a@example.com>\n\n")), 0, true},
+		{"gzip", gz("compressed", large), uint32(len(large)), false},
+	} {
+		if size, stub, e := StoreSize(tc.path); e != nil {
+			t.Errorf("%s: %v", tc.name, e)
+		} else if size != tc.size || stub != tc.stub {
+			t.Errorf("%s: size %d stub %v, want %d %v", tc.name, size, stub, tc.size, tc.stub)
+		}
+	}
+	if _, _, e := StoreSize(filepath.Join(dir, "missing")); !os.IsNotExist(e) {
+		t.Errorf("missing: %v", e)
+	}
+}
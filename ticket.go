@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"crypto/sha256"
 	"fmt"
 	"hash"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -20,14 +22,17 @@ import (
 var NULL_BYTES [digest_length]byte
 
 type ArchiveTicket struct {
-	hasher  hash.Hash
-	batons  chan *ArchiveTicket
-	tickets chan *ArchiveTicket
-	digest  [digest_length]byte
-	file    fs.File
-	msg     *mail.Message
-	rb      []byte
-	wb      *bufio.Writer
+	canonical Canonical
+	hasher    hash.Hash
+	batons    chan *ArchiveTicket
+	tickets   chan *ArchiveTicket
+	digest    [digest_length]byte
+	variant   byte
+	notify    bool
+	file      fs.File
+	msg       *mail.Message
+	r         io.Reader // the message literal, streamed by Store
+	wb        *bufio.Writer
 }
 
 func (a *ArchiveTicket) Release() error {
@@ -59,10 +64,6 @@ func notify_send(header mail.Header) error {
 }
 
 func (a *ArchiveTicket) Submit() {
-	a.Hash()
-	if e := notify_send(a.msg.Header); e != nil {
-		log.Print(e)
-	}
 	a.tickets <- a
 }
 
@@ -71,7 +72,7 @@ func (a *ArchiveTicket) Hash() error {
 	if a.hasher == nil {
 		a.hasher = sha256.New()
 	}
-	if _, e := WriteHeaders(a.msg.Header, a.hasher); e != nil {
+	if _, e := a.canonical.WriteIdentity(a.msg.Header, a.msg.Body, a.hasher); e != nil {
 		return e
 	} else {
 		copy(a.digest[:], a.hasher.Sum(nil))
@@ -80,9 +81,11 @@ func (a *ArchiveTicket) Hash() error {
 	return nil
 }
 
-func HandleArchiveTickets(targetdir string, tickets chan *ArchiveTicket) (int, error) {
-	var first_byte string
-	var rest_bytes string
+// HandleArchiveTickets writes the messages of tickets into targetdir,
+// gzip-compressed if compress is set, and returns the number of bytes written
+// before compression. It consumes every ticket even after an error, and
+// returns the first one.
+func HandleArchiveTickets(targetdir string, compress bool, tickets chan *ArchiveTicket) (int, error) {
 	counterchan, sizes := make(chan int), make(chan int)
 	go func() {
 		var counter int
@@ -91,48 +94,110 @@ func HandleArchiveTickets(targetdir string, tickets chan *ArchiveTicket) (int, e
 		}
 		counterchan <- counter
 	}()
+	errs := make(chan error, 1)
 	for ticket := range tickets {
-		first_byte = fmt.Sprintf("%02x", ticket.digest[0])
-		rest_bytes = fmt.Sprintf("%02x", ticket.digest[1:])
-		if i, e := os.Stat(filepath.Join(targetdir, first_byte)); e != nil {
-			if e := os.MkdirAll(filepath.Join(targetdir, first_byte), os.ModePerm); e != nil {
-				ticket.Release()
-				return 0, e
-			}
-		} else if !i.IsDir() {
-			ticket.Release()
-			return 0, fmt.Errorf("invalid target directory structure")
-		}
-		go func(ticket *ArchiveTicket, first_byte string, rest_bytes string) {
+		go func(ticket *ArchiveTicket) {
 			defer ticket.Release()
-			if g, e := os.CreateTemp(targetdir, ".tmp_message"); e != nil {
-				panic(e)
-			} else {
-				ticket.wb.Reset(g)
-				if n, e := ticket.wb.Write(ticket.rb); e != nil {
-					panic(e)
-				} else if e := ticket.wb.Flush(); e != nil {
-					panic(e)
-				} else if e := g.Close(); e != nil {
-					panic(e)
-				} else if e := os.Rename(g.Name(), filepath.Join(targetdir, first_byte, rest_bytes)); e != nil {
-					panic(e)
-				} else {
-					sizes <- n
+			if n, e := ticket.Store(targetdir, compress); e != nil {
+				select {
+				case errs <- e:
+				default:
 				}
+			} else {
+				sizes <- n
 			}
-		}(ticket, first_byte, rest_bytes)
+		}(ticket)
 	}
 	close(sizes)
 
-	return <-counterchan, nil
+	counter := <-counterchan
+	select {
+	case e := <-errs:
+		return counter, e
+	default:
+		return counter, nil
+	}
+}
+
+// Store streams the message of a into a temporary file in targetdir,
+// computing its digest on the way, and then moves it to its store path.
+// It returns the number of bytes before compression. go-imap has already
+// read the whole literal into memory, so this saves copies, but a message
+// still takes its size in memory while it is stored.
+func (a *ArchiveTicket) Store(targetdir string, compress bool) (int, error) {
+	g, e := os.CreateTemp(targetdir, ".tmp_message")
+	if e != nil {
+		return 0, e
+	}
+	defer os.Remove(g.Name())
+	defer g.Close()
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(g)
+		a.wb.Reset(zw)
+	} else {
+		a.wb.Reset(g)
+	}
+	n := &byte_counter{w: a.wb}
+	if m, e := mail.ReadMessage(io.TeeReader(a.r, n)); e != nil {
+		return 0, e
+	} else {
+		a.msg = m
+	}
+	if e := a.Hash(); e != nil {
+		return 0, e
+	} else if _, e := io.Copy(io.Discard, a.msg.Body); e != nil {
+		// the rest of the body, if not read for the digest
+		return 0, e
+	} else if e := a.wb.Flush(); e != nil {
+		return 0, e
+	} else if zw != nil {
+		if e := zw.Close(); e != nil {
+			return 0, e
+		}
+	}
+	if !a.notify {
+		// nothing to do
+	} else if e := notify_send(a.msg.Header); e != nil {
+		log.Print(e)
+	}
+	path := StorePath(targetdir, a.digest[:], a.variant)
+	if e := g.Close(); e != nil {
+		return 0, e
+	} else if e := os.MkdirAll(filepath.Dir(path), os.ModePerm); e != nil {
+		return 0, e
+	} else if !compress {
+		return n.n, os.Rename(g.Name(), path)
+	} else if e := os.Rename(g.Name(), path+".gz"); e != nil {
+		return 0, e
+	} else if e := os.Remove(path); e != nil && !os.IsNotExist(e) {
+		// the header stub would shadow the compressed message
+		return 0, e
+	}
+	return n.n, nil
+}
+
+// byte_counter counts the bytes written through it.
+type byte_counter struct {
+	w io.Writer
+	n int
+}
+
+func (c *byte_counter) Write(p []byte) (int, error) {
+	k, e := c.w.Write(p)
+	c.n += k
+	return k, e
 }
 
 type ResponseTicket struct {
-	uid     uint32
-	digest  [digest_length]byte
-	headers mail.Header
-	flags   byte
+	canonical Canonical
+	uid       uint32
+	digest    [digest_length]byte
+	headers   mail.Header
+	flags     byte
+	date      uint32 // INTERNALDATE, unix seconds
+	size      uint32 // RFC822.SIZE
+	variant   byte
 }
 
 type IndexTicket struct {
@@ -142,43 +207,71 @@ type IndexTicket struct {
 	flags    byte
 }
 
+// IndexTickets are sorted by uid, see IndexData.GenerateIndexTickets.
+type IndexTickets []*IndexTicket
+
+// Lookup returns the ticket of uid, or nil if it is not in the index.
+func (indextickets IndexTickets) Lookup(uid uint32) *IndexTicket {
+	k := sort.Search(len(indextickets), func(i int) bool {
+		return uid <= indextickets[i].uid
+	})
+	if k == len(indextickets) || indextickets[k].uid != uid {
+		return nil
+	}
+	return indextickets[k]
+}
+
 var stat_mutex sync.Mutex
 
-func (t *ResponseTicket) Stat(dir string) (err error) {
-	first_byte := fmt.Sprintf("%02x", t.digest[0])
-	rest_bytes := fmt.Sprintf("%02x", t.digest[1:])
+// Stat finds the variant of the message in dir: distinct messages with the
+// same digest, told apart by their size, are stored as numbered variants.
+// If none matches, a header stub is created for a new variant. Stat reports
+// whether the message is archived, and otherwise needs to be fully fetched,
+// also when only the stub of an interrupted run exists.
+func (t *ResponseTicket) Stat(dir string) (exists bool, err error) {
 	stat_mutex.Lock()
 	defer stat_mutex.Unlock()
-	if _, e := os.Stat(filepath.Join(dir, first_byte, rest_bytes)); e == nil {
-		return nil
-	} else if _, e := os.Stat(filepath.Join(dir, first_byte, rest_bytes) + ".gz"); e == nil {
-		return nil
-	} else {
-		if e := os.MkdirAll(filepath.Join(dir, first_byte), os.ModePerm); e != nil {
-			panic(e)
-		} else if f, e := os.Create(filepath.Join(dir, first_byte, rest_bytes)); e != nil {
-			panic(e)
-		} else if _, e := t.WriteTo(f); e != nil {
-			panic(e)
-		} else if e := f.Close(); e != nil {
-			panic(e)
+	for t.variant = 0; t.variant < 0xff; t.variant++ {
+		if size, stub, e := StoreSize(StorePath(dir, t.digest[:], t.variant)); os.IsNotExist(e) {
+			break
+		} else if e != nil {
+			return false, e
+		} else if t.size == 0 || size == 0 || size == t.size {
+			return !stub, nil
 		}
-		return fmt.Errorf("did not exist")
 	}
+	if *dry_run {
+		return false, nil
+	}
+	first_byte := fmt.Sprintf("%02x", t.digest[0])
+	if e := os.MkdirAll(filepath.Join(dir, first_byte), os.ModePerm); e != nil {
+		return false, e
+	} else if f, e := os.Create(StorePath(dir, t.digest[:], t.variant)); e != nil {
+		return false, e
+	} else if _, e := t.WriteTo(f); e != nil {
+		f.Close()
+		return false, e
+	} else if e := f.Close(); e != nil {
+		return false, e
+	}
+	return false, nil
 }
 
+// the size of the message a header stub stands in for
+const stub_size_header = "X-Archive-Size"
+
 func (t *ResponseTicket) WriteTo(w io.Writer) (int64, error) {
-	if n, e := WriteHeaders(t.headers, w); e != nil {
+	if n, e := t.canonical.WriteHeaders(t.headers, w); e != nil {
 		return int64(n), e
-	} else if _, e := w.Write([]byte{'\n'}); e != nil {
-		panic(e)
+	} else if k, e := fmt.Fprintf(w, "%s: %d\n\n", stub_size_header, t.size); e != nil {
+		return int64(n + k), e
 	} else {
-		return int64(n + 1), nil
+		return int64(n + k), nil
 	}
 }
 
 func (t *ResponseTicket) Read(b []byte) (n int, e error) {
-	if len(b) < 5+digest_length {
+	if len(b) < index_record_size {
 		return 0, fmt.Errorf("not enough space")
 	}
 	for k := 0; k < 4; k++ {
@@ -187,21 +280,22 @@ func (t *ResponseTicket) Read(b []byte) (n int, e error) {
 	}
 	copy(b[4:digest_length+4], t.digest[:])
 	b[4+digest_length] = t.flags
-	return 25, nil
+	put_uint32(b[5+digest_length:9+digest_length], t.date)
+	b[variant_offset] = t.variant
+	return index_record_size, nil
 }
 
 type FlagTicket struct {
 	old_flags byte
 	new_flags byte
 	digest    []byte
+	variant   byte
 	custom    []string
 }
 
 func (fl *FlagTicket) WriteTo(w io.Writer) (n int64, e error) {
-	first := fmt.Sprintf("%02x", fl.digest[0])
-	rest := fmt.Sprintf("%02x", fl.digest[1:])
 	if tags := fl.Tags(); len(tags) != 0 {
-		if k, e := fmt.Fprintf(w, "%s %s\n", strings.Join(tags, " "), filepath.Join(*targetdir, first, rest)); e != nil {
+		if k, e := fmt.Fprintf(w, "%s %s\n", strings.Join(tags, " "), StorePath(*targetdir, fl.digest, fl.variant)); e != nil {
 			return n + int64(k), e
 		} else {
 			n += int64(k)
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"testing"
+)
+
+func TestResponseTicketStat(t *testing.T) {
+	dir := t.TempDir()
+	ticket := func(size uint32) *ResponseTicket {
+		return &ResponseTicket{
+			canonical: Canonical{"Message-ID"},
+			digest:    [digest_length]byte{0xab, 0xcd},
+			headers:   mail.Header{"Message-Id": {"<a@example.com>"}},
+			size:      size,
+		}
+	}
+	stat := func(name string, rt *ResponseTicket, exists bool, variant byte) {
+		t.Helper()
+		if ok, e := rt.Stat(dir); e != nil {
+			t.Fatalf("%s: %v", name, e)
+		} else if ok != exists || rt.variant != variant {
+			t.Errorf("%s: exists %v variant %d, want %v %d", name, ok, rt.variant, exists, variant)
+		}
+	}
+
+	stat("new", ticket(100), false, 0)
+	path := StorePath(dir, ticket(0).digest[:], 0)
+	if size, stub, e := StoreSize(path); e != nil || !stub || size != 100 {
+		t.Fatalf("stub: size %d stub %v, %v", size, stub, e)
+	}
+	// an interrupted run left only the stub
+	stat("stub", ticket(100), false, 0)
+	if e := os.WriteFile(path, bytes.Repeat([]byte("x"), 100), 0644); e != nil {
+		t.Fatal(e)
+	}
+	stat("archived", ticket(100), true, 0)
+	stat("unknown size", ticket(0), true, 0)
+	stat("other size", ticket(200), false, 1)
+	stat("other size again", ticket(200), false, 1)
+	stat("third size", ticket(300), false, 2)
+}
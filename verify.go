@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// StoreDigest recomputes the digest of the store file at path from its
+// canonical headers.
+func StoreDigest(path string, canonical Canonical) (digest [digest_length]byte, e error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(path, ".gz") {
+		if r, e = gzip.NewReader(r); e != nil {
+			return
+		}
+	}
+	m, e := mail.ReadMessage(r)
+	if e != nil {
+		return
+	}
+	hasher := sha256.New()
+	if _, e = canonical.WriteIdentity(m.Header, m.Body, hasher); e != nil {
+		return
+	}
+	copy(digest[:], hasher.Sum(nil))
+	return
+}
+
+// Verify checks the store in targetdir against the index files in indexdir:
+// every indexed message must be fully archived, every store file must match
+// its digest, and no temporary or unreferenced files may be left over. It
+// returns the number of problems found, and with repair set, re-fetches
+// the broken messages of the accounts configured on stdin.
+func Verify(indexdir string, targetdir string) (int, error) {
+	var problems int
+	// mailbox id -> uids to re-fetch
+	broken := make(map[string]*imap.SeqSet)
+	referenced := make(map[string]bool)
+
+	entries, e := os.ReadDir(indexdir)
+	if e != nil {
+		return 0, e
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !IsIndexName(entry.Name()) {
+			continue
+		}
+		id := &IndexData{filename: filepath.Join(indexdir, entry.Name())}
+		if e := id.ReadIndexFile(); e != nil {
+			fmt.Printf("index %s: %s\n", entry.Name(), e)
+			problems++
+			continue
+		}
+		for _, b := range id.indexbytes {
+			digest := [digest_length]byte(b[4 : digest_length+4])
+			path := RecordPath(targetdir, b[:])
+			referenced[path] = true
+			if !Archived(targetdir, digest[:], b[variant_offset]) {
+				fmt.Printf("missing %s %s\n", entry.Name(), path)
+			} else if _, e := os.Stat(path + ".gz"); e == nil {
+				if d, e := StoreDigest(path+".gz", id.canonical); e == nil && d == digest {
+					continue
+				}
+				fmt.Printf("corrupt %s %s.gz\n", entry.Name(), path)
+			} else if d, e := StoreDigest(path, id.canonical); e == nil && d == digest {
+				continue
+			} else {
+				fmt.Printf("corrupt %s %s\n", entry.Name(), path)
+			}
+			problems++
+			if broken[entry.Name()] == nil {
+				broken[entry.Name()] = new(imap.SeqSet)
+			}
+			broken[entry.Name()].AddNum(read_uint32(b[:4]))
+		}
+	}
+
+	e = filepath.WalkDir(targetdir, func(path string, d os.DirEntry, e error) error {
+		if e != nil {
+			return e
+		} else if d.IsDir() {
+			return nil
+		} else if strings.HasPrefix(d.Name(), ".tmp_message") {
+			// left over from an interrupted HandleArchiveTickets
+			fmt.Printf("orphan %s\n", path)
+			problems++
+			if *repair {
+				return os.Remove(path)
+			}
+			return nil
+		}
+		name, variant, _ := strings.Cut(strings.TrimSuffix(d.Name(), ".gz"), ".")
+		if b, e := hex.DecodeString(filepath.Base(filepath.Dir(path)) + name); e != nil || len(b) != digest_length {
+			fmt.Printf("unknown %s\n", path)
+			problems++
+			return nil
+		} else if v, e := strconv.ParseUint(variant, 10, 8); variant != "" && (e != nil || v == 0) {
+			fmt.Printf("unknown %s\n", path)
+			problems++
+			return nil
+		}
+		if !referenced[strings.TrimSuffix(path, ".gz")] {
+			fmt.Printf("unreferenced %s\n", path)
+			problems++
+		}
+		return nil
+	})
+	if e != nil {
+		return problems, e
+	}
+
+	if *repair && len(broken) > 0 {
+		if e := Refetch(broken); e != nil {
+			return problems, e
+		}
+	}
+	return problems, nil
+}
+
+// Refetch downloads the messages in broken again, for every mailbox of the
+// accounts configured on stdin.
+func Refetch(broken map[string]*imap.SeqSet) error {
+	accounts, e := ReadAccounts(os.Stdin)
+	if e != nil {
+		return e
+	}
+	for _, ac := range accounts {
+		conf, e := OpenAccount(ac)
+		if e != nil {
+			return e
+		}
+		cc, e := conf.InitClient()
+		if e != nil {
+			return e
+		}
+		for _, mailbox := range conf.folders {
+			mailbox_id := GenerateMailboxID(mailbox, conf.addr, conf.salt)
+			seq, ok := broken[mailbox_id]
+			if !ok {
+				continue
+			}
+			delete(broken, mailbox_id)
+			id := &IndexData{
+				mailboxname: mailbox,
+				filename:    filepath.Join(*indexdir, mailbox_id),
+				addr:        conf.addr,
+				cc:          cc,
+				compress:    conf.compress,
+				canonical:   conf.canonical,
+				errs:        make(chan error, 1),
+			}
+			// the variant of each uid, so that the right file is replaced
+			if e := id.ReadIndexFile(); e != nil {
+				return e
+			}
+			e := id.HandleFullFetched(id.FetchFull(seq))
+			id.busy.Wait()
+			select {
+			case e := <-id.errs:
+				fmt.Fprintf(os.Stderr, "refetch %s: %s\n", mailbox, e)
+			default:
+			}
+			if e != nil {
+				return e
+			}
+		}
+		// every connection of the account
+		if e := (&IndexData{cc: cc}).Disconnect(); e != nil {
+			fmt.Fprintf(os.Stderr, "refetch %s: %s\n", conf.Name(), e)
+		}
+	}
+	for mailbox_id := range broken {
+		fmt.Fprintf(os.Stderr, "refetch %s: no configured account\n", mailbox_id)
+	}
+	return nil
+}
@@ -1,13 +1,61 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-imap"
 )
 
-func WriteHeaders(headers mail.Header, w io.Writer) (n int, e error) {
-	for _, h := range canonical_header_list {
+// Canonical is the list of headers whose values identify a message.
+type Canonical []string
+
+// ParseCanonical parses a comma separated list of headers, returning the
+// default list if s is empty.
+func ParseCanonical(s string) Canonical {
+	if strings.TrimSpace(s) == "" {
+		return canonical_header_list
+	}
+	list := make(Canonical, 0, 2)
+	for _, h := range strings.Split(s, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			list = append(list, h)
+		}
+	}
+	return list
+}
+
+func (list Canonical) String() string {
+	return strings.Join(list, ",")
+}
+
+// section: canonical headers for hashing
+func (list Canonical) Section() *imap.BodySectionName {
+	return &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{
+			Specifier: imap.HeaderSpecifier,
+			Fields:    list,
+		},
+		Peek: true,
+	}
+}
+
+// fetch items: canonical headers
+func (list Canonical) FetchItems() []imap.FetchItem {
+	return []imap.FetchItem{
+		list.Section().FetchItem(),
+		imap.FetchUid,
+		imap.FetchFlags,
+		imap.FetchInternalDate,
+		imap.FetchRFC822Size,
+	}
+}
+
+func (list Canonical) WriteHeaders(headers mail.Header, w io.Writer) (n int, e error) {
+	for _, h := range list {
 		if v := headers.Get(h); v != "" {
 			if k, e := fmt.Fprintf(w, "%s: %s\n", h, v); e != nil {
 				return n + k, e
@@ -18,3 +66,80 @@ func WriteHeaders(headers mail.Header, w io.Writer) (n int, e error) {
 	}
 	return n, nil
 }
+
+func (list Canonical) Has(headers mail.Header) bool {
+	for _, h := range list {
+		if headers.Get(h) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteFallback writes the fallback headers of a message, followed by the
+// SHA-256 of its body with line endings normalized to LF.
+func WriteFallback(headers mail.Header, body io.Reader, w io.Writer) (n int, e error) {
+	for _, h := range fallback_header_list {
+		if k, e := fmt.Fprintf(w, "%s: %s\n", h, headers.Get(h)); e != nil {
+			return n + k, e
+		} else {
+			n += k
+		}
+	}
+	// the body is hashed as it is read, with CRLF as LF
+	hasher := sha256.New()
+	if body != nil {
+		lw := &lf_writer{w: hasher}
+		if _, e := io.Copy(lw, body); e != nil {
+			return n, e
+		}
+		lw.Flush()
+	}
+	if k, e := fmt.Fprintf(w, "Body: %x\n", hasher.Sum(nil)); e != nil {
+		return n + k, e
+	} else {
+		return n + k, nil
+	}
+}
+
+// WriteIdentity writes what the digest of a message is computed over: its
+// canonical headers, or if it has none, its fallback identity. The body is
+// only read in the latter case.
+func (list Canonical) WriteIdentity(headers mail.Header, body io.Reader, w io.Writer) (n int, e error) {
+	if list.Has(headers) {
+		return list.WriteHeaders(headers, w)
+	}
+	return WriteFallback(headers, body, w)
+}
+
+// lf_writer writes to w with every CRLF as LF, also across writes.
+type lf_writer struct {
+	w  io.Writer
+	cr bool // the last byte written was a CR, held back
+}
+
+func (lw *lf_writer) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if lw.cr && c != '\n' {
+			out = append(out, '\r')
+		}
+		if lw.cr = c == '\r'; !lw.cr {
+			out = append(out, c)
+		}
+	}
+	if _, e := lw.w.Write(out); e != nil {
+		return 0, e
+	}
+	return len(p), nil
+}
+
+// Flush writes a trailing CR.
+func (lw *lf_writer) Flush() error {
+	if lw.cr {
+		lw.cr = false
+		_, e := lw.w.Write([]byte{'\r'})
+		return e
+	}
+	return nil
+}
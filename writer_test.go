@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWriteFallback(t *testing.T) {
+	headers := mail.Header{"From": {"a@example.com"}, "Subject": {"x"}}
+	for _, body := range []string{"", "a\r\nb\r\n", "a\r\r\nb", "trailing\r", "\r\n\r\n", "no newline"} {
+		var want bytes.Buffer
+		for _, h := range fallback_header_list {
+			fmt.Fprintf(&want, "%s: %s\n", h, headers.Get(h))
+		}
+		fmt.Fprintf(&want, "Body: %x\n", sha256.Sum256([]byte(strings.ReplaceAll(body, "\r\n", "\n"))))
+		// one byte at a time, so that CRLF is split across writes
+		var got bytes.Buffer
+		if n, e := WriteFallback(headers, iotest.OneByteReader(strings.NewReader(body)), &got); e != nil {
+			t.Fatal(e)
+		} else if n != got.Len() {
+			t.Errorf("%q: wrote %d bytes, returned %d", body, got.Len(), n)
+		}
+		if got.String() != want.String() {
+			t.Errorf("%q: got %q, want %q", body, got.String(), want.String())
+		}
+	}
+}